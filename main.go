@@ -1,24 +1,156 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/reillywatson/gocache/server"
 	"github.com/reillywatson/gocache/storage"
+	"github.com/reillywatson/gocache/storage/local"
+	"github.com/reillywatson/gocache/storage/remote"
 )
 
 var (
-	cacheDir  = flag.String("dir", "", "cache directory")
-	s3Bucket  = flag.String("s3-bucket", "", "Amazon S3 bucket name")
-	gcsBucket = flag.String("gcs-bucket", "", "Google CLoud Storage bucket name")
-	cacheKey  = flag.String("key", "", "cache key")
-	verbose   = flag.Bool("verbose", false, "print detail log")
+	cacheDir       = flag.String("dir", "", "cache directory")
+	remoteURL      = flag.String("remote", "", "remote cache URL, such as s3://bucket/prefix, gs://bucket/prefix, azblob://container/prefix, file:///dir, https://host/path, grpcs://host:port/instance, redis://host, oci://registry/repository or gha://")
+	tiers          []string
+	s3Bucket       = flag.String("s3-bucket", "", "Amazon S3 bucket name")
+	gcsBucket      = flag.String("gcs-bucket", "", "Google CLoud Storage bucket name")
+	httpURL        = flag.String("http-url", "", "HTTP cache server base URL")
+	reapi          = flag.String("reapi", "", "Remote Execution API cache address (host:port)")
+	redisURL       = flag.String("redis", "", "Redis or Valkey URL (redis://[[user]:password@]host[:port][/db], rediss:// for TLS)")
+	azureContainer = flag.String("azure-container", "", "Azure Blob Storage container name")
+	sharedDir      = flag.String("shared-dir", "", "directory shared between hosts, such as an NFS or SMB mount, used as remote cache")
+	ociRepository  = flag.String("oci-repository", "", "OCI registry repository, such as ghcr.io/org/gocache")
+	githubActions  = flag.Bool("github-actions", false, "use the GitHub Actions cache service")
+	cacheKey       = flag.String("key", "", "cache key")
+	verbose        = flag.Bool("verbose", false, "print detail log")
+
+	maxBytes      = flag.Int64("max-bytes", 0, "maximum size of the local cache in bytes (0 for no limit)")
+	maxEntries    = flag.Int64("max-entries", 0, "maximum number of entries in the local cache (0 for no limit)")
+	evictInterval = flag.Duration("evict-interval", time.Minute, "how often the estimated size of the local cache is checked against its limits")
+	trimAge       = flag.Duration("trim-age", 0, "trim local cache entries unused for this long (0 to disable)")
+	trimInterval  = flag.Duration("trim-interval", 24*time.Hour, "minimum time between two trims of the local cache")
+	verify        = flag.Bool("verify", false, "verify the SHA-256 of cached objects against their OutputID")
+
+	remoteMode    = flag.String("remote-mode", "read-write", "operations on the remote cache: read-write, read-only or write-only")
+	writeBehind   = flag.Bool("write-behind", false, "upload to the remote cache in the background instead of during puts")
+	uploadWorkers = flag.Int("upload-workers", 4, "number of concurrent background uploads in write-behind mode")
+	uploadRetries = flag.Int("upload-retries", 3, "number of retries of a failed background upload in write-behind mode")
+	drainTimeout  = flag.Duration("drain-timeout", 30*time.Second, "how long to wait for background uploads on close in write-behind mode")
+	uploadQueue   = flag.Int("upload-queue-size", 1024, "maximum number of queued uploads in write-behind mode, above which puts upload in the foreground")
+	skipExisting  = flag.Bool("skip-existing", false, "look objects up in the remote cache before uploading them, and skip those already stored")
+
+	remoteGetTimeout    = flag.Duration("remote-get-timeout", 0, "deadline of a get from the remote cache, including the download (0 for none)")
+	remotePutTimeout    = flag.Duration("remote-put-timeout", 0, "deadline of a put to the remote cache (0 for none)")
+	remoteSlowThreshold = flag.Duration("remote-slow-threshold", 0, "duration above which a remote call counts as a failure for the breaker (0 to disable)")
+	breakerFailures     = flag.Int("breaker-failures", 0, "consecutive remote failures or slow calls after which the remote cache is disabled (0 to disable)")
+	breakerCooldown     = flag.Duration("breaker-cooldown", 0, "how long the remote cache stays disabled once the breaker opens (0 for the rest of the run)")
+
+	s3RetryMaxAttempts   = flag.Int("s3-retry-max-attempts", 0, "maximum number of attempts of an Amazon S3 request (0 for the SDK default)")
+	s3RetryMaxBackoff    = flag.Duration("s3-retry-max-backoff", 0, "maximum delay between two attempts of an Amazon S3 request (0 for the SDK default)")
+	s3MultipartThreshold = flag.Int64("s3-multipart-threshold", 100<<20, "size from which objects are uploaded to Amazon S3 in parts (0 to disable)")
+	s3PartSize           = flag.Int64("s3-part-size", 0, "size of the parts of Amazon S3 multipart uploads (0 for the SDK default)")
+	s3Endpoint           = flag.String("s3-endpoint", "", "endpoint URL of an S3-compatible service such as MinIO, Cloudflare R2 or Ceph RGW")
+	s3PathStyle          = flag.Bool("s3-path-style", false, "address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>")
+	s3Region             = flag.String("s3-region", "", "Amazon S3 region (default from the AWS config)")
+	s3Profile            = flag.String("s3-profile", "", "AWS shared config profile (default $AWS_PROFILE)")
+
+	gcsEndpoint        = flag.String("gcs-endpoint", "", "Google Cloud Storage JSON API endpoint, e.g. for fake-gcs-server (also $STORAGE_EMULATOR_HOST)")
+	gcsCredentialsFile = flag.String("gcs-credentials-file", "", "Google Cloud credentials JSON file (default Application Default Credentials)")
+	gcsAnonymous       = flag.Bool("gcs-anonymous", false, "send unauthenticated requests to Google Cloud Storage")
+	gcsSkipBucketCheck = flag.Bool("gcs-skip-bucket-check", false, "do not check that the Google Cloud Storage bucket exists on start")
+
+	httpToken       = flag.String("http-token", "", "bearer token for the HTTP cache server (default $GOCACHE_HTTP_TOKEN)")
+	httpUser        = flag.String("http-user", "", "basic auth user for the HTTP cache server")
+	httpPassword    = flag.String("http-password", "", "basic auth password for the HTTP cache server (default $GOCACHE_HTTP_PASSWORD)")
+	httpBazelRemote = flag.Bool("http-bazel-remote", false, "use the /ac/ and /cas/ layout of bazel-remote on the HTTP cache server")
+	httpHeader      = http.Header{}
+
+	reapiInstance = flag.String("reapi-instance", "", "Remote Execution API instance name")
+	reapiTLS      = flag.Bool("reapi-tls", false, "connect to the Remote Execution API cache with TLS")
+	reapiCAFile   = flag.String("reapi-ca-file", "", "PEM file of the CA certificates of the Remote Execution API cache")
+	reapiCertFile = flag.String("reapi-cert-file", "", "client certificate for mutual TLS with the Remote Execution API cache")
+	reapiKeyFile  = flag.String("reapi-key-file", "", "client key for mutual TLS with the Remote Execution API cache")
+	reapiHeader   = map[string]string{}
+
+	redisTTL           = flag.Duration("redis-ttl", 7*24*time.Hour, "how long objects are kept in Redis (0 to keep them forever)")
+	redisMaxObjectSize = flag.Int64("redis-max-object-size", 16<<20, "size above which objects are not stored in Redis (0 for no limit)")
+	redisTLS           = flag.Bool("redis-tls", false, "connect to Redis with TLS")
+
+	azureAccountURL       = flag.String("azure-account-url", "", "Azure Blob Storage service URL (https://<account>.blob.core.windows.net)")
+	azureConnectionString = flag.String("azure-connection-string", "", "Azure Storage connection string (default $AZURE_STORAGE_CONNECTION_STRING)")
+	azureSASToken         = flag.String("azure-sas-token", "", "Azure Blob Storage SAS token (default $AZURE_STORAGE_SAS_TOKEN)")
+
+	ociUsername = flag.String("oci-username", "", "OCI registry user (default $GOCACHE_OCI_USERNAME, or the Docker config)")
+	ociPassword = flag.String("oci-password", "", "OCI registry password or token (default $GOCACHE_OCI_PASSWORD, or the Docker config)")
+	ociInsecure = flag.Bool("oci-insecure", false, "connect to the OCI registry over plain HTTP or without verifying TLS")
+
+	githubActionsURL        = flag.String("github-actions-url", "", "GitHub Actions legacy cache service URL, for GitHub Enterprise Server (default $ACTIONS_CACHE_URL)")
+	githubActionsResultsURL = flag.String("github-actions-results-url", "", "GitHub Actions cache service v2 URL (default $ACTIONS_RESULTS_URL if $ACTIONS_CACHE_SERVICE_V2 is set)")
+	githubActionsToken      = flag.String("github-actions-token", "", "GitHub Actions runtime token (default $ACTIONS_RUNTIME_TOKEN)")
+
+	maxGets = flag.Int64("max-gets", 64, "maximum number of get requests handled concurrently (0 for no limit)")
+	maxPuts = flag.Int64("max-puts", 16, "maximum number of put requests handled concurrently (0 for no limit)")
 )
 
+func init() {
+	flag.Func("tier", "`URL` of a remote cache tier, from the fastest to the slowest, with optional read=through|skip and write=through|back|skip options (repeatable)", func(s string) error {
+		tiers = append(tiers, s)
+		return nil
+	})
+	headerFlag("http-header", "`name: value` header sent to the HTTP cache server (repeatable)", httpHeader.Add)
+	headerFlag("reapi-header", "`name: value` metadata sent to the Remote Execution API cache, e.g. for authorization (repeatable)", func(name, value string) {
+		reapiHeader[strings.ToLower(name)] = value
+	})
+}
+
+// headerFlag defines a repeatable flag of "name: value" headers.
+func headerFlag(name, usage string, add func(name, value string)) {
+	flag.Func(name, usage, func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("header %q is not in the form name: value", s)
+		}
+		add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+}
+
+// envDefault sets a flag that was left empty to the environment variable
+// key. Secrets are read this way rather than used as flag defaults, which
+// the flag package prints in the usage message.
+func envDefault(value *string, key string) {
+	if *value == "" {
+		*value = os.Getenv(key)
+	}
+}
+
+// githubActionsCacheV2 reports whether the runner uses the GitHub Actions
+// cache service v2, the same way as @actions/cache: the runner sets
+// ACTIONS_CACHE_SERVICE_V2, and GitHub Enterprise Server only has the legacy
+// service.
+func githubActionsCacheV2() bool {
+	if os.Getenv("ACTIONS_CACHE_SERVICE_V2") == "" {
+		return false
+	}
+	u, err := url.Parse(cmp.Or(os.Getenv("GITHUB_SERVER_URL"), "https://github.com"))
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "github.com" || strings.HasSuffix(host, ".ghe.com") || strings.HasSuffix(host, ".localhost")
+}
+
 const defaultCacheKey = "v1"
 
 func defaultCacheDir() string {
@@ -32,6 +164,20 @@ func defaultCacheDir() string {
 
 func main() {
 	flag.Parse()
+	envDefault(httpToken, "GOCACHE_HTTP_TOKEN")
+	envDefault(httpPassword, "GOCACHE_HTTP_PASSWORD")
+	envDefault(azureConnectionString, "AZURE_STORAGE_CONNECTION_STRING")
+	envDefault(azureSASToken, "AZURE_STORAGE_SAS_TOKEN")
+	envDefault(ociUsername, "GOCACHE_OCI_USERNAME")
+	envDefault(ociPassword, "GOCACHE_OCI_PASSWORD")
+	envDefault(githubActionsToken, "ACTIONS_RUNTIME_TOKEN")
+	if *githubActionsURL == "" && *githubActionsResultsURL == "" {
+		if githubActionsCacheV2() {
+			*githubActionsResultsURL = os.Getenv("ACTIONS_RESULTS_URL")
+		} else {
+			*githubActionsURL = os.Getenv("ACTIONS_CACHE_URL")
+		}
+	}
 	if *cacheDir == "" {
 		*cacheDir = defaultCacheDir()
 	}
@@ -40,12 +186,112 @@ func main() {
 		a := defaultCacheKey
 		cacheKey = &a
 	}
+	mode, err := local.ParseRemoteMode(*remoteMode)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	localStorage := storage.New(ctx, *cacheDir, *s3Bucket, *gcsBucket, *cacheKey, *verbose)
-	process := server.NewProcess(localStorage, *verbose)
+	localStorage, err := storage.New(ctx, storage.Options{
+		CacheDir:       *cacheDir,
+		RemoteURL:      *remoteURL,
+		Tiers:          tiers,
+		S3Bucket:       *s3Bucket,
+		GCSBucket:      *gcsBucket,
+		HTTPURL:        *httpURL,
+		REAPITarget:    *reapi,
+		RedisURL:       *redisURL,
+		AzureContainer: *azureContainer,
+		SharedDir:      *sharedDir,
+		OCIRepository:  *ociRepository,
+		GitHubActions:  *githubActions,
+		CacheKey:       *cacheKey,
+		Verbose:        *verbose,
+		Disk: local.DiskOptions{
+			MaxBytes:      *maxBytes,
+			MaxEntries:    *maxEntries,
+			EvictInterval: *evictInterval,
+			TrimAge:       *trimAge,
+			TrimInterval:  *trimInterval,
+			Verify:        *verify,
+		},
+		Breaker: remote.BreakerOptions{
+			GetTimeout:    *remoteGetTimeout,
+			PutTimeout:    *remotePutTimeout,
+			SlowThreshold: *remoteSlowThreshold,
+			Failures:      *breakerFailures,
+			Cooldown:      *breakerCooldown,
+		},
+		Remote: local.MergeRemoteOptions{
+			Mode:          mode,
+			WriteBehind:   *writeBehind,
+			UploadWorkers: *uploadWorkers,
+			UploadRetries: *uploadRetries,
+			DrainTimeout:  *drainTimeout,
+			QueueSize:     *uploadQueue,
+			SkipExisting:  *skipExisting,
+		},
+		HTTP: remote.HTTPOptions{
+			BearerToken: *httpToken,
+			Username:    *httpUser,
+			Password:    *httpPassword,
+			Header:      httpHeader,
+			BazelRemote: *httpBazelRemote,
+		},
+		REAPI: remote.REAPIOptions{
+			InstanceName: *reapiInstance,
+			TLS:          *reapiTLS,
+			CAFile:       *reapiCAFile,
+			CertFile:     *reapiCertFile,
+			KeyFile:      *reapiKeyFile,
+			Header:       reapiHeader,
+		},
+		Redis: remote.RedisOptions{
+			TTL:           *redisTTL,
+			MaxObjectSize: *redisMaxObjectSize,
+			TLS:           *redisTLS,
+		},
+		GCS: remote.GoogleCloudStorageOptions{
+			Endpoint:        *gcsEndpoint,
+			CredentialsFile: *gcsCredentialsFile,
+			Anonymous:       *gcsAnonymous,
+			SkipBucketCheck: *gcsSkipBucketCheck,
+		},
+		Azure: remote.AzureBlobOptions{
+			AccountURL:       *azureAccountURL,
+			ConnectionString: *azureConnectionString,
+			SASToken:         *azureSASToken,
+		},
+		OCI: remote.OCIOptions{
+			Username: *ociUsername,
+			Password: *ociPassword,
+			Insecure: *ociInsecure,
+		},
+		Actions: remote.GitHubActionsOptions{
+			URL:        *githubActionsURL,
+			ResultsURL: *githubActionsResultsURL,
+			Token:      *githubActionsToken,
+		},
+		S3: remote.AmazonS3Options{
+			RetryMaxAttempts:   *s3RetryMaxAttempts,
+			RetryMaxBackoff:    *s3RetryMaxBackoff,
+			MultipartThreshold: *s3MultipartThreshold,
+			PartSize:           *s3PartSize,
+			Endpoint:           *s3Endpoint,
+			UsePathStyle:       *s3PathStyle,
+			Region:             *s3Region,
+			Profile:            *s3Profile,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	process := server.NewProcess(localStorage, server.Limits{
+		MaxGets: *maxGets,
+		MaxPuts: *maxPuts,
+	}, *verbose)
 	if err := process.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// bodyReader streams the body of a put request straight from the input. The
+// body is a base64-encoded JSON string that follows the request, and is
+// decoded as it is read instead of being buffered in memory.
+//
+// Requests cannot be parsed until the body has been consumed, so done is
+// closed once the closing quote has been read, or the body failed to decode.
+type bodyReader struct {
+	dec  io.Reader
+	size int64
+	n    int64
+	err  error
+	done chan struct{}
+	once sync.Once
+}
+
+func newBodyReader(br *bufio.Reader, size int64) (*bodyReader, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading put body: %w", noEOF(err))
+		}
+		if c == '"' {
+			break
+		}
+		if !isSpace(c) {
+			return nil, fmt.Errorf("reading put body: unexpected %q before string", c)
+		}
+	}
+	return &bodyReader{
+		dec:  base64.NewDecoder(base64.StdEncoding, &stringReader{br: br}),
+		size: size,
+		done: make(chan struct{}),
+	}, nil
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.dec.Read(p)
+	b.n += int64(n)
+	switch {
+	case b.n > b.size:
+		err = fmt.Errorf("got more than the declared %d bytes", b.size)
+	case err == io.EOF && b.n != b.size:
+		err = fmt.Errorf("only got %d bytes of declared %d", b.n, b.size)
+	case err != nil && err != io.EOF:
+		err = fmt.Errorf("reading put body: %w", noEOF(err))
+	}
+	if err != nil {
+		b.err = err
+		b.once.Do(func() { close(b.done) })
+	}
+	return n, err
+}
+
+// drain consumes whatever the handler did not read, so that the next request
+// can be parsed.
+func (b *bodyReader) drain() {
+	_, _ = io.Copy(io.Discard, b)
+	b.once.Do(func() { close(b.done) })
+}
+
+// wait blocks until the body has been consumed, and returns the error that
+// left the input unreadable, if any.
+func (b *bodyReader) wait() error {
+	<-b.done
+	if b.err == io.EOF {
+		return nil
+	}
+	return b.err
+}
+
+// stringReader reads the contents of a JSON string, up to the closing quote.
+// Only the escapes that can appear in base64 are supported.
+type stringReader struct {
+	br  *bufio.Reader
+	eof bool
+}
+
+func (s *stringReader) Read(p []byte) (int, error) {
+	if s.eof {
+		return 0, io.EOF
+	}
+	if _, err := s.br.Peek(1); err != nil {
+		return 0, noEOF(err)
+	}
+	chunk, _ := s.br.Peek(min(s.br.Buffered(), len(p)))
+	i := bytes.IndexAny(chunk, `"\`)
+	if i < 0 {
+		n := copy(p, chunk)
+		_, _ = s.br.Discard(n)
+		return n, nil
+	}
+	if i > 0 {
+		n := copy(p, chunk[:i])
+		_, _ = s.br.Discard(n)
+		return n, nil
+	}
+	if chunk[0] == '"' {
+		_, _ = s.br.Discard(1)
+		s.eof = true
+		return 0, io.EOF
+	}
+	esc := make([]byte, 2)
+	if _, err := io.ReadFull(s.br, esc); err != nil {
+		return 0, noEOF(err)
+	}
+	if esc[1] != '/' {
+		return 0, fmt.Errorf("unexpected escape %q in base64 string", esc)
+	}
+	p[0] = '/'
+	return 1, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for input that ends in the
+// middle of a value.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/reillywatson/gocache/server/internal/cacheprog"
+)
+
+// putLines returns a put request for body declaring size bytes, as sent by
+// the go command.
+func putLines(id int, body []byte, size int) string {
+	return fmt.Sprintf("{\"ID\":%d,\"Command\":\"put\",\"BodySize\":%d}\n\"%s\"\n", id, size, base64.StdEncoding.EncodeToString(body))
+}
+
+// escapeSlashes escapes the slashes of s, as some JSON encoders do.
+func escapeSlashes(s string) string {
+	return strings.ReplaceAll(s, "/", `\/`)
+}
+
+// testBody returns n bytes whose base64 encoding has slashes.
+func testBody(n int) []byte {
+	body := make([]byte, n)
+	for i := range body {
+		body[i] = byte(0xff - i)
+	}
+	return body
+}
+
+// parseAll parses every request in input, reading the bodies of the puts.
+func parseAll(t *testing.T, input string, bufSize int) ([]*cacheprog.Request, [][]byte, error) {
+	t.Helper()
+	var p Process
+	br := bufio.NewReaderSize(strings.NewReader(input), bufSize)
+	var reqs []*cacheprog.Request
+	var bodies [][]byte
+	for {
+		req, err := p.parseRequest(br)
+		if errors.Is(err, io.EOF) {
+			return reqs, bodies, nil
+		}
+		if err != nil {
+			return reqs, bodies, err
+		}
+		reqs = append(reqs, req)
+		var data []byte
+		if body, ok := req.Body.(*bodyReader); ok {
+			data, err = io.ReadAll(body)
+			if err != nil {
+				return reqs, bodies, err
+			}
+			if err := body.wait(); err != nil {
+				return reqs, bodies, err
+			}
+		}
+		bodies = append(bodies, data)
+	}
+}
+
+func TestParsePutBody(t *testing.T) {
+	for _, escape := range []bool{false, true} {
+		// The buffer holds 16 bytes, which is 12 bytes of body once decoded.
+		for _, n := range []int{1, 2, 3, 11, 12, 13, 15, 16, 17, 100, 1000} {
+			t.Run(fmt.Sprintf("%d bytes, escaped %v", n, escape), func(t *testing.T) {
+				body := testBody(n)
+				input := putLines(1, body, n) + `{"ID":2,"Command":"get"}` + "\n"
+				if escape {
+					input = escapeSlashes(input)
+				}
+				reqs, bodies, err := parseAll(t, input, 16)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(reqs) != 2 || reqs[1].Command != cacheprog.CmdGet {
+					t.Fatalf("parsed %d requests, want the put and the get", len(reqs))
+				}
+				if !bytes.Equal(bodies[0], body) {
+					t.Errorf("body = %x, want %x", bodies[0], body)
+				}
+			})
+		}
+	}
+}
+
+func TestParsePutBodyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"short", putLines(1, []byte("a"), 5), "only got 1 bytes of declared 5"},
+		{"long", putLines(1, []byte("abcde"), 1), "got more than the declared 1 bytes"},
+		{"EOF in body", `{"ID":1,"Command":"put","BodySize":5}` + "\n\"YWJj", "unexpected EOF"},
+		{"EOF before body", `{"ID":1,"Command":"put","BodySize":5}` + "\n", "unexpected EOF"},
+		{"not a string", `{"ID":1,"Command":"put","BodySize":5}` + "\n5", "unexpected '5' before string"},
+		{"bad escape", `{"ID":1,"Command":"put","BodySize":3}` + "\n\"\\nYWJj\"", `unexpected escape "\\n"`},
+		{"bad base64", `{"ID":1,"Command":"put","BodySize":3}` + "\n\"Y!Jj\"", "illegal base64 data"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseAll(t, tt.input, 16)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// A handler that does not read the body still lets the next request be
+// parsed once it is drained.
+func TestParsePutBodyNotRead(t *testing.T) {
+	var p Process
+	input := escapeSlashes(putLines(1, testBody(100), 100)) + `{"ID":2,"Command":"get"}` + "\n"
+	br := bufio.NewReaderSize(strings.NewReader(input), 16)
+	req, err := p.parseRequest(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body.(*bodyReader)
+	if _, err := body.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	body.drain()
+	if err := body.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if req, err := p.parseRequest(br); err != nil || req.ID != 2 {
+		t.Fatalf("next request = %+v, %v; want the get", req, err)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/reillywatson/gocache/storage/local"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/reillywatson/gocache/server/internal/cacheprog"
 )
@@ -25,25 +26,48 @@ var (
 	ErrNoOutputID     = errors.New("no outputID")
 )
 
+// Limits bounds the requests that a Process handles concurrently. Once a
+// limit is reached, further requests of the same type wait until one
+// completes. Gets and puts are limited separately, so that slow gets do not
+// hold up puts and the other way around. Zero means no limit.
+type Limits struct {
+	// MaxGets is the maximum number of get requests in flight.
+	MaxGets int64
+	// MaxPuts is the maximum number of put requests in flight.
+	MaxPuts int64
+}
+
 type Process struct {
 	cache    local.Storage
 	closer   sync.Once
 	errClose error
 	verbose  bool
+	gets     *semaphore.Weighted
+	puts     *semaphore.Weighted
 }
 
-func NewProcess(cache local.Storage, verbose bool) *Process {
-	return &Process{
+func NewProcess(cache local.Storage, limits Limits, verbose bool) *Process {
+	p := &Process{
 		cache:   cache,
 		verbose: verbose,
 	}
+	if limits.MaxGets > 0 {
+		p.gets = semaphore.NewWeighted(limits.MaxGets)
+	}
+	if limits.MaxPuts > 0 {
+		p.puts = semaphore.NewWeighted(limits.MaxPuts)
+	}
+	return p
 }
 
 func (p *Process) Run(ctx context.Context) error {
-	br := bufio.NewReader(os.Stdin)
-	jd := json.NewDecoder(br)
+	return p.run(ctx, os.Stdin, os.Stdout)
+}
 
-	bw := bufio.NewWriter(os.Stdout)
+func (p *Process) run(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	bw := bufio.NewWriter(w)
 	je := json.NewEncoder(bw)
 	caps := []cacheprog.Cmd{cacheprog.CmdGet, cacheprog.CmdPut, cacheprog.CmdClose}
 	if err := je.Encode(&cacheprog.Response{KnownCommands: caps}); err != nil {
@@ -65,44 +89,126 @@ func (p *Process) Run(ctx context.Context) error {
 		_ = wg.Wait()
 	}()
 	for {
-		req, err := p.parseRequest(jd)
+		req, err := p.parseRequest(br)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
 		}
+		body, _ := req.Body.(*bodyReader)
 		wg.Go(func() error {
 			res := &cacheprog.Response{ID: req.ID}
-			if err := p.handleRequest(ctx, req, res); err != nil {
+			release, err := p.acquire(ctx, req)
+			if err == nil {
+				err = p.handleRequest(ctx, req, res)
+				release()
+			}
+			if err != nil {
 				res.Err = err.Error()
 			}
+			if body != nil {
+				body.drain()
+			}
 			wmu.Lock()
 			defer wmu.Unlock()
 			_ = je.Encode(res)
 			_ = bw.Flush()
 			return nil
 		})
+		// The body is streamed from the input, so the next request can only
+		// be parsed once the handler has consumed it. Bodies are never held
+		// in memory, so they need no budget of their own.
+		if body != nil {
+			if err := body.wait(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// acquire waits until req fits within the limit of its type, and returns a
+// function that releases it once it has been handled. A put that has to wait
+// first spools its body to a temporary file, so that the requests behind it
+// can be parsed in the meantime.
+func (p *Process) acquire(ctx context.Context, req *cacheprog.Request) (func(), error) {
+	var sem *semaphore.Weighted
+	switch req.Command {
+	case cacheprog.CmdGet:
+		sem = p.gets
+	case cacheprog.CmdPut:
+		sem = p.puts
+	}
+	if sem == nil {
+		return func() {}, nil
+	}
+	if sem.TryAcquire(1) {
+		return func() { sem.Release(1) }, nil
+	}
+	cleanup := func() {}
+	if body, ok := req.Body.(*bodyReader); ok {
+		f, err := spool(body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = f
+		cleanup = func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}
+	if err := sem.Acquire(ctx, 1); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return func() {
+		sem.Release(1)
+		cleanup()
+	}, nil
+}
+
+// spool copies body to a temporary file, and returns it rewound.
+func spool(body io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "gocache-put-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
 	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("spooling put body: %w", err)
+	}
+	return f, nil
 }
 
-func (p *Process) parseRequest(jd *json.Decoder) (*cacheprog.Request, error) {
+// parseRequest reads the next request. Each request is a JSON object on its
+// own line; the body of a put is returned as a reader over the input.
+func (p *Process) parseRequest(br *bufio.Reader) (*cacheprog.Request, error) {
+	var line []byte
+	for len(bytes.TrimSpace(line)) == 0 {
+		var err error
+		line, err = br.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 	var req cacheprog.Request
-	if err := jd.Decode(&req); err != nil {
+	if err := json.Unmarshal(line, &req); err != nil {
 		return nil, err
 	}
-	if req.Command == cacheprog.CmdPut {
-		if req.BodySize > 0 {
-			// io.Reader that validates on EOF.
-			var bodyb []byte
-			if err := jd.Decode(&bodyb); err != nil {
-				return nil, err
-			}
-			if int64(len(bodyb)) != req.BodySize {
-				return nil, fmt.Errorf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
-			}
-			req.Body = bytes.NewReader(bodyb)
+	if req.Command == cacheprog.CmdPut && req.BodySize > 0 {
+		body, err := newBodyReader(br, req.BodySize)
+		if err != nil {
+			return nil, err
 		}
+		req.Body = body
 	}
 
 	return &req, nil
@@ -129,7 +235,7 @@ func (p *Process) handleRequest(ctx context.Context, req *cacheprog.Request, res
 }
 
 func (p *Process) handleGet(ctx context.Context, req *cacheprog.Request, res *cacheprog.Response) (retErr error) {
-	outputID, diskPath, err := p.cache.Get(ctx, fmt.Sprintf("%x", req.ActionID))
+	outputID, diskPath, putTime, err := p.cache.Get(ctx, fmt.Sprintf("%x", req.ActionID))
 	if err != nil {
 		return err
 	}
@@ -157,6 +263,9 @@ func (p *Process) handleGet(ctx context.Context, req *cacheprog.Request, res *ca
 	}
 	res.Size = fi.Size()
 	res.DiskPath = diskPath
+	if !putTime.IsZero() {
+		res.Time = &putTime
+	}
 	return nil
 }
 
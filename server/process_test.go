@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reillywatson/gocache/server/internal/cacheprog"
+)
+
+// slowStorage is a local storage whose puts of the slow action are stuck in
+// an upload until release is closed.
+type slowStorage struct {
+	dir     string
+	release chan struct{}
+}
+
+func (s *slowStorage) Kind() string                { return "slow" }
+func (s *slowStorage) Start(context.Context) error { return nil }
+func (s *slowStorage) Close() error                { return nil }
+func (s *slowStorage) Summary() string             { return "" }
+
+func (s *slowStorage) Get(context.Context, string) (string, string, time.Time, error) {
+	return "", "", time.Time{}, nil
+}
+
+func (s *slowStorage) Put(_ context.Context, actionID, _ string, _ int64, body io.Reader) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	diskPath := filepath.Join(s.dir, actionID)
+	if err := os.WriteFile(diskPath, data, 0644); err != nil {
+		return "", err
+	}
+	if actionID == "51" {
+		<-s.release
+	}
+	return diskPath, nil
+}
+
+// A put waiting for a put slot does not hold up the requests behind it.
+func TestProcessPutLimit(t *testing.T) {
+	storage := &slowStorage{dir: t.TempDir(), release: make(chan struct{})}
+	p := NewProcess(storage, Limits{MaxPuts: 1}, false)
+	stdin, input := io.Pipe()
+	output, stdout := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- p.run(context.Background(), stdin, stdout) }()
+
+	go func() {
+		_, _ = io.WriteString(input, `{"ID":1,"Command":"put","ActionID":"UQ==","OutputID":"AQ==","BodySize":4}`+"\n\"c2xvdw==\"\n")
+		_, _ = io.WriteString(input, `{"ID":2,"Command":"put","ActionID":"Ug==","OutputID":"Ag==","BodySize":7}`+"\n\"d2FpdGluZw==\"\n")
+		_, _ = io.WriteString(input, `{"ID":3,"Command":"get","ActionID":"Uw=="}`+"\n")
+	}()
+	dec := json.NewDecoder(output)
+	responses := make(chan *cacheprog.Response)
+	go func() {
+		for {
+			var res cacheprog.Response
+			if err := dec.Decode(&res); err != nil {
+				close(responses)
+				return
+			}
+			responses <- &res
+		}
+	}()
+	<-responses // the capabilities
+
+	select {
+	case res := <-responses:
+		if res.ID != 3 || !res.Miss {
+			t.Fatalf("response %+v, want the get miss", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the get was held up by the puts")
+	}
+	close(storage.release)
+	for range 2 {
+		res := <-responses
+		if res.Err != "" {
+			t.Errorf("put %d: %s", res.ID, res.Err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(storage.dir, "52")); err != nil || string(data) != "waiting" {
+		t.Errorf("waiting put stored %q, %v; want %q", data, err, "waiting")
+	}
+	_ = input.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
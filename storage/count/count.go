@@ -12,11 +12,23 @@ type Count struct {
 	Puts      atomic.Int64
 	GetErrors atomic.Int64
 	PutErrors atomic.Int64
+	// VerifyFailures counts the corrupt entries, such as objects whose content
+	// did not match their OutputID.
+	VerifyFailures atomic.Int64
+	// SkippedPuts counts the puts that were not uploaded because the object
+	// was already stored.
+	SkippedPuts atomic.Int64
 }
 
 func (c *Count) Summary(kind string) string {
 	getsLine := fmt.Sprintf("[%s] %d gets, %d hits, %d misses, %d errors", kind, c.Gets.Load(), c.Hits.Load(), c.Misses.Load(), c.GetErrors.Load())
+	if n := c.VerifyFailures.Load(); n > 0 {
+		getsLine += fmt.Sprintf(", %d verify failures", n)
+	}
 	putsLine := fmt.Sprintf("[%s] %d puts, %d errors", kind, c.Puts.Load(), c.PutErrors.Load())
+	if n := c.SkippedPuts.Load(); n > 0 {
+		putsLine += fmt.Sprintf(", %d skipped as already stored", n)
+	}
 
 	return fmt.Sprintf("%s\n%s", getsLine, putsLine)
 }
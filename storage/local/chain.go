@@ -0,0 +1,355 @@
+package local
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// ReadPolicy is how a Chain reads from a tier.
+type ReadPolicy int
+
+const (
+	// ReadThrough looks objects up in the tier when the faster tiers miss.
+	ReadThrough ReadPolicy = iota
+	// ReadSkip never reads from the tier.
+	ReadSkip
+)
+
+func (p ReadPolicy) String() string {
+	switch p {
+	case ReadThrough:
+		return "read-through"
+	case ReadSkip:
+		return "read-skip"
+	default:
+		return fmt.Sprintf("ReadPolicy(%d)", int(p))
+	}
+}
+
+// ParseReadPolicy parses "through" or "skip".
+func ParseReadPolicy(s string) (ReadPolicy, error) {
+	switch s {
+	case "through":
+		return ReadThrough, nil
+	case "skip":
+		return ReadSkip, nil
+	default:
+		return 0, fmt.Errorf("unknown read policy %q, expected through or skip", s)
+	}
+}
+
+// WritePolicy is how a Chain writes to a tier.
+type WritePolicy int
+
+const (
+	// WriteThrough uploads objects to the tier before Put returns.
+	WriteThrough WritePolicy = iota
+	// WriteBack uploads objects to the tier in the background.
+	WriteBack
+	// WriteSkip never writes to the tier.
+	WriteSkip
+)
+
+func (p WritePolicy) String() string {
+	switch p {
+	case WriteThrough:
+		return "write-through"
+	case WriteBack:
+		return "write-back"
+	case WriteSkip:
+		return "write-skip"
+	default:
+		return fmt.Sprintf("WritePolicy(%d)", int(p))
+	}
+}
+
+// ParseWritePolicy parses "through", "back" or "skip".
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	switch s {
+	case "through":
+		return WriteThrough, nil
+	case "back":
+		return WriteBack, nil
+	case "skip":
+		return WriteSkip, nil
+	default:
+		return 0, fmt.Errorf("unknown write policy %q, expected through, back or skip", s)
+	}
+}
+
+// Tier is a remote storage of a Chain, with its read and write policies.
+type Tier struct {
+	Storage remote.Storage
+	Read    ReadPolicy
+	Write   WritePolicy
+	// Fast places the tier ahead of the local storage, such as a memory
+	// tier. Only the leading tiers of a chain can be fast; the others are
+	// placed behind the local storage.
+	Fast bool
+}
+
+type chainTier struct {
+	Tier
+	name        string
+	uploader    *uploader
+	hits        atomic.Int64
+	promotions  atomic.Int64
+	skippedGets atomic.Int64
+	skippedPuts atomic.Int64
+}
+
+// Chain is a storage that is backed by a local storage and an ordered list of
+// remote tiers, from the fastest to the slowest. The local storage sits behind
+// the fast tiers and ahead of the others. Gets are served by the first of them
+// that has the object; the object is then written to the local storage and
+// promoted into the faster tiers. Puts write to the local storage, then to
+// every tier according to its write policy.
+type Chain struct {
+	localStorage Storage
+	tiers        []*chainTier
+	front        int // number of tiers ahead of the local storage
+	skipExisting bool
+	verbose      bool
+}
+
+var _ Storage = &Chain{}
+
+// NewChain creates a Chain of the tiers. The upload options of opts apply to
+// the write-back tiers, and SkipExisting to all.
+func NewChain(localStorage Storage, tiers []Tier, opts MergeRemoteOptions, verbose bool) *Chain {
+	if opts.UploadWorkers <= 0 {
+		opts.UploadWorkers = 4
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = 30 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	c := &Chain{
+		localStorage: localStorage,
+		skipExisting: opts.SkipExisting,
+		verbose:      verbose,
+	}
+	for i, tier := range tiers {
+		t := &chainTier{
+			Tier: tier,
+			name: fmt.Sprintf("tier %d %s", i+1, tier.Storage.Kind()),
+		}
+		if tier.Write == WriteBack {
+			t.uploader = newUploader(tier.Storage, opts, verbose)
+			t.uploader.name = t.name + " write-back"
+		}
+		if tier.Fast && c.front == i {
+			c.front++
+		}
+		c.tiers = append(c.tiers, t)
+	}
+	return c
+}
+
+func (c *Chain) Kind() string {
+	return "chain"
+}
+
+func (c *Chain) Start(ctx context.Context) error {
+	if err := c.localStorage.Start(ctx); err != nil {
+		_ = c.localStorage.Close()
+		return fmt.Errorf("local cache start failed: %w", err)
+	}
+	for i, t := range c.tiers {
+		if err := t.Storage.Start(ctx); err != nil {
+			_ = t.Storage.Close()
+			_ = c.close(c.tiers[:i])
+			return fmt.Errorf("%s start failed: %w", t.name, err)
+		}
+		if t.uploader != nil {
+			t.uploader.start(ctx)
+		}
+		if c.verbose {
+			place := "behind"
+			if i < c.front {
+				place = "ahead of"
+			}
+			log.Printf("[%s] %s: %s, %s, %s the local cache", c.Kind(), t.name, t.Read, t.Write, place)
+		}
+	}
+	return nil
+}
+
+func (c *Chain) Get(ctx context.Context, actionID string) (string, string, time.Time, error) {
+	var localErr, tierErr error
+	for i := range len(c.tiers) + 1 {
+		if i == c.front {
+			outputID, diskPath, putTime, err := c.localStorage.Get(ctx, actionID)
+			if err == nil && outputID != "" {
+				c.promoteLocal(ctx, actionID, outputID, diskPath)
+				return outputID, diskPath, putTime, nil
+			}
+			localErr = err
+		}
+		if i == len(c.tiers) {
+			break
+		}
+		t := c.tiers[i]
+		if t.Read == ReadSkip {
+			t.skippedGets.Add(1)
+			continue
+		}
+		outputID, size, putTime, body, err := t.Storage.Get(ctx, actionID)
+		if err != nil {
+			// A failing tier must not hide the slower ones.
+			tierErr = errors.Join(tierErr, err)
+			continue
+		}
+		if outputID == "" {
+			continue
+		}
+		diskPath, err := c.backfill(ctx, t, actionID, outputID, size, putTime, body)
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		t.hits.Add(1)
+		c.promote(ctx, i, uploadJob{actionID: actionID, outputID: outputID, size: size, diskPath: diskPath})
+		return outputID, diskPath, putTime, nil
+	}
+	return "", "", time.Time{}, cmp.Or(localErr, tierErr)
+}
+
+// backfill writes an object read from a tier to the local storage.
+func (c *Chain) backfill(ctx context.Context, t *chainTier, actionID, outputID string, size int64, putTime time.Time, body io.ReadCloser) (string, error) {
+	defer body.Close()
+	diskPath, err := backfill(ctx, c.localStorage, actionID, outputID, size, &sizeCheckReader{r: body, size: size}, putTime)
+	if err != nil {
+		return "", fmt.Errorf("local cache backfill failed for %s: %w", actionID, err)
+	}
+	if c.verbose {
+		log.Printf("[%s] backfilled %s from %s (outputID: %s, size: %d)", c.Kind(), actionID, t.name, outputID, size)
+	}
+	return diskPath, nil
+}
+
+// promoteLocal writes an object found in the local storage to the tiers ahead
+// of it.
+func (c *Chain) promoteLocal(ctx context.Context, actionID, outputID, diskPath string) {
+	if c.front == 0 {
+		return
+	}
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		log.Printf("Warning: [%s] promotion of %s failed: %v", c.Kind(), actionID, err)
+		return
+	}
+	c.promote(ctx, c.front, uploadJob{actionID: actionID, outputID: outputID, size: fi.Size(), diskPath: diskPath})
+}
+
+// promote writes an object found in the tier at index hit to the faster tiers.
+// Failures are only logged, since the object is already served.
+func (c *Chain) promote(ctx context.Context, hit int, job uploadJob) {
+	for _, t := range c.tiers[:hit] {
+		if t.Write == WriteSkip {
+			continue
+		}
+		if err := c.write(ctx, t, job); err != nil {
+			log.Printf("Warning: [%s] promotion of %s to %s failed: %v", c.Kind(), job.actionID, t.name, err)
+			continue
+		}
+		t.promotions.Add(1)
+	}
+}
+
+// write writes an object from the local storage to a tier, according to its
+// write policy. A write-back tier whose queue is full is written through.
+func (c *Chain) write(ctx context.Context, t *chainTier, job uploadJob) error {
+	if t.Write == WriteSkip || t.Write == WriteBack && t.uploader.enqueue(job) {
+		return nil
+	}
+	err := uploadFile(ctx, t.Storage, job.actionID, job.outputID, job.size, job.diskPath, c.skipExisting)
+	if errors.Is(err, remote.ErrBreakerOpen) {
+		return nil
+	}
+	return err
+}
+
+// Put writes the object to the local storage, then to every tier that
+// accepts writes. It fails if a write-through tier fails, after trying all.
+func (c *Chain) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	diskPath, err := c.localStorage.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		log.Printf("[%s] error: %v", c.localStorage.Kind(), err)
+		return "", err
+	}
+
+	job := uploadJob{actionID: actionID, outputID: outputID, size: size, diskPath: diskPath}
+	var errAll error
+	for _, t := range c.tiers {
+		if t.Write == WriteSkip {
+			t.skippedPuts.Add(1)
+			continue
+		}
+		if err := c.write(ctx, t, job); err != nil {
+			errAll = errors.Join(errAll, err)
+		}
+	}
+	if errAll != nil {
+		return "", errAll
+	}
+	return diskPath, nil
+}
+
+func (c *Chain) Close() error {
+	return c.close(c.tiers)
+}
+
+// close stops the uploaders of the tiers, then closes the local storage and
+// the tiers.
+func (c *Chain) close(tiers []*chainTier) error {
+	for _, t := range tiers {
+		if t.uploader != nil {
+			t.uploader.close()
+		}
+	}
+	var errAll error
+	if err := c.localStorage.Close(); err != nil {
+		errAll = errors.Join(errAll, fmt.Errorf("local cache close failed: %w", err))
+	}
+	for _, t := range tiers {
+		if err := t.Storage.Close(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("%s close failed: %w", t.name, err))
+		}
+	}
+	return errAll
+}
+
+// Summary reports the statistics of the local storage and of every tier,
+// followed by the hits and promotions of each tier.
+func (c *Chain) Summary() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n%s", c.localStorage.Summary())
+	for _, t := range c.tiers {
+		fmt.Fprintf(&sb, "\n%s", t.Storage.Summary())
+		if t.uploader != nil {
+			fmt.Fprintf(&sb, "\n%s", t.uploader.summary())
+		}
+	}
+	for _, t := range c.tiers {
+		fmt.Fprintf(&sb, "\n[%s] %s: %s, %s, %d hits, %d promotions", c.Kind(), t.name, t.Read, t.Write, t.hits.Load(), t.promotions.Load())
+		if t.Read == ReadSkip {
+			fmt.Fprintf(&sb, ", %d gets skipped", t.skippedGets.Load())
+		}
+		if t.Write == WriteSkip {
+			fmt.Fprintf(&sb, ", %d puts skipped", t.skippedPuts.Load())
+		}
+	}
+	return sb.String()
+}
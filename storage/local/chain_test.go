@@ -0,0 +1,167 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+func newTestDisk(t *testing.T) *Disk {
+	t.Helper()
+	return NewDisk(false, t.TempDir(), DiskOptions{})
+}
+
+// actionIDOf returns an action ID, which must be hex to be sharded.
+func actionIDOf(name string) string {
+	return outputIDOf([]byte("action " + name))
+}
+
+func outputIDOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func putMemory(t *testing.T, m *remote.Memory, actionID string, data []byte) {
+	t.Helper()
+	if err := m.Put(context.Background(), actionID, outputIDOf(data), int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startChain(t *testing.T, c *Chain) {
+	t.Helper()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+}
+
+func getChain(t *testing.T, c *Chain, actionID string, want []byte) {
+	t.Helper()
+	outputID, diskPath, _, err := c.Get(context.Background(), actionID)
+	if err != nil || outputID != outputIDOf(want) {
+		t.Fatalf("Get = %q, %v; want %q", outputID, err, outputIDOf(want))
+	}
+	if got, err := os.ReadFile(diskPath); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Get: file holds %q, %v; want %q", got, err, want)
+	}
+}
+
+// A fast tier is looked up before the local storage, which is looked up before
+// the other tiers. Hits are promoted into the faster tiers.
+func TestChainFastTier(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDisk(t)
+	mem, slow := remote.NewMemory(1<<20, false), remote.NewMemory(1<<20, false)
+	c := NewChain(disk, []Tier{{Storage: mem, Fast: true}, {Storage: slow}}, MergeRemoteOptions{}, false)
+	startChain(t, c)
+
+	putMemory(t, mem, actionIDOf("fast"), []byte("fast"))
+	getChain(t, c, actionIDOf("fast"), []byte("fast"))
+	if n := disk.Count.Gets.Load(); n != 0 {
+		t.Errorf("disk gets = %d after a fast tier hit, want 0", n)
+	}
+	if outputID, _, _, err := disk.Get(ctx, actionIDOf("fast")); err != nil || outputID != outputIDOf([]byte("fast")) {
+		t.Errorf("disk Get = %q, %v; want the backfilled object", outputID, err)
+	}
+
+	if _, err := disk.Put(ctx, actionIDOf("local"), outputIDOf([]byte("local")), 5, strings.NewReader("local")); err != nil {
+		t.Fatal(err)
+	}
+	getChain(t, c, actionIDOf("local"), []byte("local"))
+	if outputID, _, _, _, _ := mem.Get(ctx, actionIDOf("local")); outputID != outputIDOf([]byte("local")) {
+		t.Errorf("a local hit was not promoted into the fast tier")
+	}
+	if outputID, _, _, _, _ := slow.Get(ctx, actionIDOf("local")); outputID != "" {
+		t.Errorf("a local hit was promoted into a slower tier")
+	}
+
+	putMemory(t, slow, actionIDOf("slow"), []byte("slow"))
+	getChain(t, c, actionIDOf("slow"), []byte("slow"))
+	if outputID, _, _, _, _ := mem.Get(ctx, actionIDOf("slow")); outputID != outputIDOf([]byte("slow")) {
+		t.Errorf("a slow tier hit was not promoted into the fast tier")
+	}
+}
+
+// Only the leading tiers of a chain can be ahead of the local storage.
+func TestChainFastTierBehindSlowTier(t *testing.T) {
+	slow, mem := remote.NewMemory(1<<20, false), remote.NewMemory(1<<20, false)
+	c := NewChain(newTestDisk(t), []Tier{{Storage: slow}, {Storage: mem, Fast: true}}, MergeRemoteOptions{}, false)
+	if c.front != 0 {
+		t.Errorf("front = %d, want 0", c.front)
+	}
+}
+
+func TestMergeRemoteMode(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []RemoteMode{ReadWrite, ReadOnly, WriteOnly} {
+		t.Run(mode.String(), func(t *testing.T) {
+			mem := remote.NewMemory(1<<20, false)
+			putMemory(t, mem, actionIDOf("remote"), []byte("remote"))
+			c := NewMergeRemote(newTestDisk(t), mem, MergeRemoteOptions{Mode: mode}, false)
+			startChain(t, c)
+
+			outputID, _, _, err := c.Get(ctx, actionIDOf("remote"))
+			if hit := outputID != ""; err != nil || hit != (mode != WriteOnly) {
+				t.Errorf("Get = %q, %v; want a hit: %v", outputID, err, mode != WriteOnly)
+			}
+			if _, err := c.Put(ctx, actionIDOf("local"), outputIDOf([]byte("local")), 5, strings.NewReader("local")); err != nil {
+				t.Fatal(err)
+			}
+			outputID, _, _, _, _ = mem.Get(ctx, actionIDOf("local"))
+			if uploaded := outputID != ""; uploaded != (mode != ReadOnly) {
+				t.Errorf("uploaded = %v, want %v", uploaded, mode != ReadOnly)
+			}
+		})
+	}
+}
+
+// closeRecorder records whether the storages are closed.
+type closeRecorder struct {
+	*remote.Memory
+	startErr error
+	closed   bool
+}
+
+func (r *closeRecorder) Start(ctx context.Context) error {
+	if r.startErr != nil {
+		return r.startErr
+	}
+	return r.Memory.Start(ctx)
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return r.Memory.Close()
+}
+
+type closeRecorderDisk struct {
+	*Disk
+	closed bool
+}
+
+func (d *closeRecorderDisk) Close() error {
+	d.closed = true
+	return d.Disk.Close()
+}
+
+// A failed start closes the storages that were already started.
+func TestChainStartFailure(t *testing.T) {
+	disk := &closeRecorderDisk{Disk: newTestDisk(t)}
+	started := &closeRecorder{Memory: remote.NewMemory(1<<20, false)}
+	failed := &closeRecorder{Memory: remote.NewMemory(1<<20, false), startErr: errors.New("no credentials")}
+	c := NewChain(disk, []Tier{{Storage: started, Write: WriteBack}, {Storage: failed}}, MergeRemoteOptions{}, false)
+	if err := c.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Fatalf("Start error = %v, want the tier error", err)
+	}
+	if !disk.closed || !started.closed || !failed.closed {
+		t.Errorf("closed: local %v, started tier %v, failed tier %v; want all closed", disk.closed, started.closed, failed.closed)
+	}
+}
@@ -0,0 +1,129 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Coalesce is a storage that deduplicates the concurrent calls for the same
+// action: the gets share a single lookup, which may fetch the object from the
+// remote cache, and the puts of the same output share a single write.
+type Coalesce struct {
+	storage Storage
+	verbose bool
+
+	gets singleflight.Group
+
+	mu   sync.Mutex
+	puts map[string]*putCall // by action, output and size
+
+	collapsedGets atomic.Int64
+	collapsedPuts atomic.Int64
+}
+
+var _ Storage = &Coalesce{}
+
+func NewCoalesce(storage Storage, verbose bool) *Coalesce {
+	return &Coalesce{
+		storage: storage,
+		verbose: verbose,
+		puts:    map[string]*putCall{},
+	}
+}
+
+func (c *Coalesce) Kind() string {
+	return "coalesce"
+}
+
+func (c *Coalesce) Start(ctx context.Context) error {
+	return c.storage.Start(ctx)
+}
+
+type getResult struct {
+	outputID string
+	diskPath string
+	putTime  time.Time
+}
+
+func (c *Coalesce) Get(ctx context.Context, actionID string) (string, string, time.Time, error) {
+	v, err := do(ctx, &c.gets, &c.collapsedGets, actionID, func() (getResult, error) {
+		outputID, diskPath, putTime, err := c.storage.Get(ctx, actionID)
+		return getResult{outputID, diskPath, putTime}, err
+	})
+	return v.outputID, v.diskPath, v.putTime, err
+}
+
+// putCall is a put in flight.
+type putCall struct {
+	done     chan struct{}
+	diskPath string
+	err      error
+}
+
+// Put writes the object, unless the same output is already being written for
+// the action, in which case it waits for that write instead. The body of a
+// collapsed put is drained first: it is streamed from the input of the go
+// command, which cannot send the next request until the body is consumed,
+// while the write in flight may wait for a remote upload.
+func (c *Coalesce) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	key := fmt.Sprintf("%s/%s/%d", actionID, outputID, size)
+	c.mu.Lock()
+	if call, ok := c.puts[key]; ok {
+		c.mu.Unlock()
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return "", err
+		}
+		select {
+		case <-call.done:
+			c.collapsedPuts.Add(1)
+			return call.diskPath, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call := &putCall{done: make(chan struct{})}
+	c.puts[key] = call
+	c.mu.Unlock()
+
+	call.diskPath, call.err = c.storage.Put(ctx, actionID, outputID, size, body)
+	c.mu.Lock()
+	delete(c.puts, key)
+	c.mu.Unlock()
+	close(call.done)
+	return call.diskPath, call.err
+}
+
+// do calls fn, or waits for the call in flight for the same key and counts
+// the collapsed call. A waiting caller gives up when its context is done.
+func do[T any](ctx context.Context, g *singleflight.Group, collapsed *atomic.Int64, key string, fn func() (T, error)) (T, error) {
+	var leader bool
+	ch := g.DoChan(key, func() (any, error) {
+		leader = true
+		return fn()
+	})
+	select {
+	case res := <-ch:
+		if !leader {
+			collapsed.Add(1)
+		}
+		v, _ := res.Val.(T)
+		return v, res.Err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (c *Coalesce) Close() error {
+	return c.storage.Close()
+}
+
+func (c *Coalesce) Summary() string {
+	return fmt.Sprintf("%s\n[%s] %d gets collapsed, %d puts collapsed", c.storage.Summary(), c.Kind(), c.collapsedGets.Load(), c.collapsedPuts.Load())
+}
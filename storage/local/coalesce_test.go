@@ -0,0 +1,72 @@
+package local
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// blockingPut is a storage whose puts read the body, then wait to be released,
+// like a write-through upload.
+type blockingPut struct {
+	*Disk
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingPut) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	diskPath, err := s.Disk.Put(ctx, actionID, outputID, size, body)
+	s.reading <- struct{}{}
+	<-s.release
+	return diskPath, err
+}
+
+// eofReader reports when its body has been read to the end.
+type eofReader struct {
+	io.Reader
+	eof chan struct{}
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		close(r.eof)
+	}
+	return n, err
+}
+
+// A collapsed put drains its body before waiting for the put in flight.
+func TestCoalescePutDrainsBody(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDisk(t)
+	if err := disk.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s := &blockingPut{Disk: disk, reading: make(chan struct{}), release: make(chan struct{})}
+	c := NewCoalesce(s, false)
+	actionID, outputID := actionIDOf("a"), outputIDOf([]byte("x"))
+
+	leader := make(chan string)
+	go func() {
+		diskPath, _ := c.Put(ctx, actionID, outputID, 1, strings.NewReader("x"))
+		leader <- diskPath
+	}()
+	<-s.reading
+
+	body := &eofReader{Reader: strings.NewReader("x"), eof: make(chan struct{})}
+	follower := make(chan string)
+	go func() {
+		diskPath, _ := c.Put(ctx, actionID, outputID, 1, body)
+		follower <- diskPath
+	}()
+	<-body.eof // before the leader is released
+	close(s.release)
+
+	if leaderPath, followerPath := <-leader, <-follower; leaderPath == "" || followerPath != leaderPath {
+		t.Errorf("disk paths = %q, %q; want the same", leaderPath, followerPath)
+	}
+	if n := c.collapsedPuts.Load(); n != 1 {
+		t.Errorf("collapsed puts = %d, want 1", n)
+	}
+}
@@ -3,13 +3,16 @@ package local
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/reillywatson/gocache/storage/count"
@@ -23,19 +26,63 @@ type indexEntry struct {
 	TimeNanos int64  `json:"t"`
 }
 
+// DiskOptions configures the size limits of a Disk.
+type DiskOptions struct {
+	// MaxBytes is the maximum total size of the cached outputs. Zero means no limit.
+	MaxBytes int64
+	// MaxEntries is the maximum number of cached actions. Zero means no limit.
+	MaxEntries int64
+	// EvictInterval is how often the estimated size of the cache is checked
+	// against its limits. The directory is only scanned at start and once the
+	// estimate exceeds them.
+	EvictInterval time.Duration
+	// TrimAge is how long an entry may go unused before it is trimmed. Zero disables trimming.
+	TrimAge time.Duration
+	// TrimInterval is the minimum time between two trims of the directory.
+	TrimInterval time.Duration
+	// Verify checks that the SHA-256 of an object matches its OutputID when it
+	// is read and written. Corrupt entries are deleted and reported as misses.
+	Verify bool
+}
+
+func (o DiskOptions) limited() bool {
+	return o.MaxBytes > 0 || o.MaxEntries > 0
+}
+
 var _ Storage = &Disk{}
 
 // Disk is a Local that stores data on disk.
 type Disk struct {
 	dir     string
 	verbose bool
+	opts    DiskOptions
 	count.Count
+
+	// usedBytes and usedEntries estimate the size of the cache since the last eviction scan.
+	usedBytes    atomic.Int64
+	usedEntries  atomic.Int64
+	evictions    atomic.Int64
+	evictedBytes atomic.Int64
+	trimmed      atomic.Int64
+	trimmedBytes atomic.Int64
+	flat         atomic.Bool // whether files of the flat layout may remain
+	evictNow     chan struct{}
+	stop         context.CancelFunc
+	stopped      chan struct{}
 }
 
-func NewDisk(verbose bool, dir string) *Disk {
+func NewDisk(verbose bool, dir string, opts DiskOptions) *Disk {
+	if opts.EvictInterval <= 0 {
+		opts.EvictInterval = time.Minute
+	}
+	if opts.TrimInterval <= 0 {
+		opts.TrimInterval = 24 * time.Hour
+	}
 	return &Disk{
-		dir:     dir,
-		verbose: verbose,
+		dir:      dir,
+		verbose:  verbose,
+		opts:     opts,
+		evictNow: make(chan struct{}, 1),
 	}
 }
 
@@ -43,40 +90,117 @@ func (d *Disk) Kind() string {
 	return "disk"
 }
 
-func (d *Disk) Start(context.Context) error {
+func (d *Disk) Start(ctx context.Context) error {
 	if d.verbose {
 		log.Printf("[%s] local cache in %s", d.Kind(), d.dir)
 	}
-	return os.MkdirAll(d.dir, 0755)
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	if err := d.makeShards(); err != nil {
+		return err
+	}
+	d.flat.Store(d.hasFlat())
+	if d.flat.Load() || d.opts.limited() || d.opts.TrimAge > 0 {
+		ctx, d.stop = context.WithCancel(ctx)
+		d.stopped = make(chan struct{})
+		go d.maintain(ctx)
+	}
+	return nil
 }
 
-func (d *Disk) Get(_ context.Context, actionID string) (outputID, diskPath string, err error) {
+// maintain migrates the flat layout, trims and enforces the size limits in
+// the background until ctx is done.
+func (d *Disk) maintain(ctx context.Context) {
+	defer close(d.stopped)
+	if d.flat.Load() {
+		if err := d.migrateFlat(); err != nil {
+			log.Printf("Warning: [%s] migration to sharded layout failed: %v", d.Kind(), err)
+		}
+	}
+	ticker := time.NewTicker(d.opts.EvictInterval)
+	defer ticker.Stop()
+	// The first scan measures the cache; later ones only run once the
+	// estimate maintained by the puts goes over the limits.
+	scan := true
+	for {
+		if d.opts.TrimAge > 0 {
+			if err := d.trim(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+		if d.opts.limited() && (scan || d.overLimit(d.usedBytes.Load(), d.usedEntries.Load(), 1)) {
+			if err := d.evict(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scan = false
+		case <-d.evictNow:
+			scan = true
+		}
+	}
+}
+
+func (d *Disk) Get(_ context.Context, actionID string) (outputID, diskPath string, putTime time.Time, err error) {
 	d.Count.Gets.Add(1)
-	actionFile := filepath.Join(d.dir, fmt.Sprintf("a-%s", actionID))
+	actionFile := d.actionFile(actionID)
 	ij, err := os.ReadFile(actionFile)
+	if os.IsNotExist(err) && d.flat.Load() {
+		d.migrateAction(actionID)
+		ij, err = os.ReadFile(actionFile)
+	}
 	if os.IsNotExist(err) {
 		d.Count.Misses.Add(1)
-		return "", "", nil
+		return "", "", time.Time{}, nil
 	}
 	if err != nil {
 		d.Count.GetErrors.Add(1)
-		return "", "", err
+		return "", "", time.Time{}, err
 	}
 	var ie indexEntry
-	if err := json.Unmarshal(ij, &ie); err != nil {
-		log.Printf("Warning: JSON error for action %q: %v", actionID, err)
-		return "", "", nil
-	}
-	if _, err := hex.DecodeString(ie.OutputID); err != nil {
+	err = json.Unmarshal(ij, &ie)
+	if err == nil {
 		// Protect against malicious non-hex OutputID on disk
-		return "", "", nil
+		_, err = hex.DecodeString(ie.OutputID)
+	}
+	if err != nil {
+		d.Count.VerifyFailures.Add(1)
+		d.Count.Misses.Add(1)
+		log.Printf("Warning: [%s] dropping corrupt index entry for action %s: %v", d.Kind(), actionID, err)
+		_ = os.Remove(actionFile)
+		return "", "", time.Time{}, nil
+	}
+	outputFile := d.outputFile(ie.OutputID)
+	if err := d.verify(outputFile, ie); err != nil {
+		if errors.Is(err, errCorrupt) {
+			d.Count.VerifyFailures.Add(1)
+			log.Printf("Warning: [%s] dropping corrupt entry for action %s: %v", d.Kind(), actionID, err)
+			_ = os.Remove(outputFile)
+			_ = os.Remove(actionFile)
+		} else if !os.IsNotExist(err) {
+			d.Count.GetErrors.Add(1)
+			return "", "", time.Time{}, err
+		}
+		d.Count.Misses.Add(1)
+		return "", "", time.Time{}, nil
 	}
-	return ie.OutputID, filepath.Join(d.dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
+	markUsed(actionFile)
+	return ie.OutputID, outputFile, time.Unix(0, ie.TimeNanos), nil
+}
+
+func (d *Disk) Put(ctx context.Context, actionID, objectID string, size int64, body io.Reader) (diskPath string, _ error) {
+	return d.PutAt(ctx, actionID, objectID, size, body, time.Now())
 }
 
-func (d *Disk) Put(_ context.Context, actionID, objectID string, size int64, body io.Reader) (diskPath string, _ error) {
+// PutAt is like Put, but records putTime as the put time of the entry, for
+// objects that were put earlier in another storage.
+func (d *Disk) PutAt(_ context.Context, actionID, objectID string, size int64, body io.Reader, putTime time.Time) (diskPath string, _ error) {
 	d.Count.Puts.Add(1)
-	file := filepath.Join(d.dir, fmt.Sprintf("o-%s", objectID))
+	file := d.outputFile(objectID)
 
 	// Special case empty files; they're both common and easier to do race-free.
 	if size == 0 {
@@ -87,6 +211,10 @@ func (d *Disk) Put(_ context.Context, actionID, objectID string, size int64, bod
 		}
 		_ = zf.Close()
 	} else {
+		h := sha256.New()
+		if d.opts.Verify {
+			body = io.TeeReader(body, h)
+		}
 		wrote, err := writeAtomic(file, body)
 		if err != nil {
 			d.Count.PutErrors.Add(1)
@@ -96,32 +224,89 @@ func (d *Disk) Put(_ context.Context, actionID, objectID string, size int64, bod
 			d.Count.PutErrors.Add(1)
 			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
 		}
+		if sum := hex.EncodeToString(h.Sum(nil)); d.opts.Verify && sum != objectID {
+			_ = os.Remove(file)
+			d.Count.VerifyFailures.Add(1)
+			d.Count.PutErrors.Add(1)
+			return "", fmt.Errorf("content hash is %s, expected OutputID %s", sum, objectID)
+		}
 	}
 
 	ij, err := json.Marshal(indexEntry{
 		Version:   1,
 		OutputID:  objectID,
 		Size:      size,
-		TimeNanos: time.Now().UnixNano(),
+		TimeNanos: putTime.UnixNano(),
 	})
 	if err != nil {
 		d.Count.PutErrors.Add(1)
 		return "", err
 	}
-	actionFile := filepath.Join(d.dir, fmt.Sprintf("a-%s", actionID))
+	actionFile := d.actionFile(actionID)
 	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
 		d.Count.PutErrors.Add(1)
 		return "", err
 	}
+	if d.opts.limited() && d.overLimit(d.usedBytes.Add(size), d.usedEntries.Add(1), 1) {
+		select {
+		case d.evictNow <- struct{}{}:
+		default:
+		}
+	}
 	return file, nil
 }
 
+// errCorrupt is returned by verify when an output does not match its index entry.
+var errCorrupt = errors.New("corrupt cache entry")
+
+// verify checks that the output file matches its index entry. The size is
+// always checked, the content hash only if verification is enabled.
+func (d *Disk) verify(outputFile string, ie indexEntry) error {
+	f, err := os.Open(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: not a regular file", errCorrupt)
+	}
+	if fi.Size() != ie.Size {
+		return fmt.Errorf("%w: size is %d, expected %d", errCorrupt, fi.Size(), ie.Size)
+	}
+	if !d.opts.Verify {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != ie.OutputID {
+		return fmt.Errorf("%w: content hash is %s, expected %s", errCorrupt, sum, ie.OutputID)
+	}
+	return nil
+}
+
 func (d *Disk) Close() error {
+	if d.stop != nil {
+		d.stop()
+		<-d.stopped
+	}
 	return nil
 }
 
 func (d *Disk) Summary() string {
-	return d.Count.Summary(d.Kind())
+	summary := d.Count.Summary(d.Kind())
+	if d.opts.limited() {
+		summary += fmt.Sprintf("\n[%s] %d evictions, %d bytes evicted", d.Kind(), d.evictions.Load(), d.evictedBytes.Load())
+	}
+	if d.opts.TrimAge > 0 {
+		summary += fmt.Sprintf("\n[%s] %d entries trimmed, %d bytes trimmed", d.Kind(), d.trimmed.Load(), d.trimmedBytes.Load())
+	}
+	return summary
 }
 
 func writeTempFile(dest string, r io.Reader) (string, int64, error) {
@@ -0,0 +1,100 @@
+package local
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A corrupt entry is a miss, and is removed so that the next put replaces it.
+func TestDiskCorruptOutput(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		verify  bool
+		corrupt bool
+	}{
+		{"truncated", "data", false, true},
+		{"hash mismatch", "DATA!", true, true},
+		{"hash mismatch unverified", "DATA!", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newLimitedDisk(t, DiskOptions{Verify: tt.verify})
+			actionID, outputID := actionIDOf("a"), outputIDOf([]byte("data!"))
+			diskPath, err := d.Put(ctx, actionID, outputID, 5, strings.NewReader("data!"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(diskPath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			gotID, _, _, err := d.Get(ctx, actionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hit := gotID != ""; hit == tt.corrupt {
+				t.Errorf("Get = %q, want a hit: %v", gotID, !tt.corrupt)
+			}
+			if n := d.Count.VerifyFailures.Load(); (n == 1) != tt.corrupt {
+				t.Errorf("verify failures = %d, want corrupt: %v", n, tt.corrupt)
+			}
+			for _, file := range []string{diskPath, d.actionFile(actionID)} {
+				if _, err := os.Stat(file); os.IsNotExist(err) != tt.corrupt {
+					t.Errorf("%s: %v, want removed: %v", file, err, tt.corrupt)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCorruptIndex(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		index string
+	}{
+		{"bad JSON", `{"v":1,"o":`},
+		{"non-hex output ID", `{"v":1,"o":"../../etc/passwd","n":1}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newLimitedDisk(t, DiskOptions{})
+			actionFile := d.actionFile(actionIDOf("a"))
+			if err := os.WriteFile(actionFile, []byte(tt.index), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if gotID, _, _, err := d.Get(context.Background(), actionIDOf("a")); err != nil || gotID != "" {
+				t.Errorf("Get = %q, %v; want a miss", gotID, err)
+			}
+			if d.Count.Misses.Load() != 1 || d.Count.VerifyFailures.Load() != 1 {
+				t.Errorf("misses = %d, verify failures = %d; want 1, 1", d.Count.Misses.Load(), d.Count.VerifyFailures.Load())
+			}
+			if _, err := os.Stat(actionFile); !os.IsNotExist(err) {
+				t.Errorf("index file: %v, want it removed", err)
+			}
+		})
+	}
+}
+
+func TestDiskPutTime(t *testing.T) {
+	ctx := context.Background()
+	d := newLimitedDisk(t, DiskOptions{})
+	putTime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	if _, err := d.PutAt(ctx, actionIDOf("at"), outputIDOf([]byte("at")), 2, strings.NewReader("at"), putTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, got, err := d.Get(ctx, actionIDOf("at")); err != nil || !got.Equal(putTime) {
+		t.Errorf("Get put time = %v, %v; want %v", got, err, putTime)
+	}
+
+	before := time.Now()
+	if _, err := d.Put(ctx, actionIDOf("now"), outputIDOf([]byte("now")), 3, strings.NewReader("now")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, got, err := d.Get(ctx, actionIDOf("now")); err != nil || got.Before(before) || got.After(time.Now()) {
+		t.Errorf("Get put time = %v, %v; want the time of the put", got, err)
+	}
+}
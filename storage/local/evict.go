@@ -0,0 +1,231 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// mtimeInterval is how stale the mtime of an action file must be before a hit
+// refreshes it. Like the go command, this avoids a write on every hit.
+const mtimeInterval = time.Hour
+
+// lowWatermark is the fraction of the limits that eviction shrinks the cache
+// to, so that it does not run again after every put.
+const lowWatermark = 0.9
+
+// diskEntry is an action found while scanning the cache directory.
+type diskEntry struct {
+	actionID string
+	modTime  time.Time
+	lastUsed time.Time
+	indexEntry
+}
+
+// markUsed records a hit on the action file so that eviction and trimming
+// see it as recently used.
+func markUsed(actionFile string) {
+	fi, err := os.Stat(actionFile)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(fi.ModTime()) < mtimeInterval {
+		return
+	}
+	_ = os.Chtimes(actionFile, now, now)
+}
+
+// scan reads the index entries of all actions in the cache directory.
+func (d *Disk) scan() ([]diskEntry, error) {
+	var entries []diskEntry
+	err := d.walk(func(dir string, de os.DirEntry) {
+		actionID, ok := strings.CutPrefix(de.Name(), "a-")
+		if !ok || strings.Contains(actionID, ".") || !de.Type().IsRegular() {
+			return
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return
+		}
+		ij, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		if err != nil {
+			return
+		}
+		var ie indexEntry
+		if err := json.Unmarshal(ij, &ie); err != nil {
+			return
+		}
+		lastUsed := fi.ModTime()
+		if t := time.Unix(0, ie.TimeNanos); t.After(lastUsed) {
+			lastUsed = t
+		}
+		entries = append(entries, diskEntry{
+			actionID:   actionID,
+			modTime:    fi.ModTime(),
+			lastUsed:   lastUsed,
+			indexEntry: ie,
+		})
+	})
+	return entries, err
+}
+
+// evictGrace is how recent an output must be for eviction to leave it alone:
+// a concurrent Put may be about to write an action that refers to it.
+const evictGrace = time.Minute
+
+// diskOutput is an output found while scanning the cache directory, along
+// with the actions that refer to it.
+type diskOutput struct {
+	outputID string
+	size     int64
+	modTime  time.Time
+	lastUsed time.Time
+	actions  []diskEntry
+}
+
+// scanOutputs reads all outputs in the cache directory, including those that
+// no action refers to anymore, and groups the actions by output. Actions
+// whose output is missing are grouped under an output of size zero.
+func (d *Disk) scanOutputs() ([]*diskOutput, int64, error) {
+	entries, err := d.scan()
+	if err != nil {
+		return nil, 0, err
+	}
+	outputs := make(map[string]*diskOutput)
+	err = d.walk(func(dir string, de os.DirEntry) {
+		outputID, ok := strings.CutPrefix(de.Name(), "o-")
+		if !ok || strings.Contains(outputID, ".") || !de.Type().IsRegular() {
+			return
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return
+		}
+		outputs[outputID] = &diskOutput{
+			outputID: outputID,
+			size:     fi.Size(),
+			modTime:  fi.ModTime(),
+			lastUsed: fi.ModTime(),
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, e := range entries {
+		o, ok := outputs[e.OutputID]
+		if !ok {
+			o = &diskOutput{outputID: e.OutputID}
+			outputs[e.OutputID] = o
+		}
+		if e.lastUsed.After(o.lastUsed) {
+			o.lastUsed = e.lastUsed
+		}
+		o.actions = append(o.actions, e)
+	}
+	return slices.Collect(maps.Values(outputs)), int64(len(entries)), nil
+}
+
+// evict removes the least recently used outputs, along with the actions that
+// refer to them, until the cache is within its configured limits. Every
+// output counts towards the size, even if no action refers to it anymore.
+func (d *Disk) evict() error {
+	outputs, totalEntries, err := d.scanOutputs()
+	if err != nil {
+		return fmt.Errorf("[%s] eviction scan failed: %w", d.Kind(), err)
+	}
+
+	var totalBytes int64
+	for _, o := range outputs {
+		totalBytes += o.size
+	}
+	defer func() {
+		d.usedBytes.Store(totalBytes)
+		d.usedEntries.Store(totalEntries)
+	}()
+	if !d.overLimit(totalBytes, totalEntries, 1) {
+		return nil
+	}
+
+	slices.SortFunc(outputs, func(a, b *diskOutput) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+	graceStart := time.Now().Add(-evictGrace)
+	var evicted, evictedBytes int64
+	for _, o := range outputs {
+		if !d.overLimit(totalBytes, totalEntries, lowWatermark) {
+			break
+		}
+		if o.modTime.After(graceStart) {
+			continue
+		}
+		removed, ok := d.removeActions(o.actions, graceStart)
+		totalEntries -= removed
+		evicted += removed
+		if !ok {
+			continue
+		}
+		if o.modTime.IsZero() {
+			// The output is missing; only its actions were left.
+			continue
+		}
+		outputFile := d.outputFile(o.outputID)
+		if fi, err := os.Stat(outputFile); err != nil || !fi.ModTime().Equal(o.modTime) {
+			// Rewritten by a Put since the scan.
+			continue
+		}
+		if err := os.Remove(outputFile); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		totalBytes -= o.size
+		evictedBytes += o.size
+	}
+	d.evictions.Add(evicted)
+	d.evictedBytes.Add(evictedBytes)
+	if d.verbose {
+		log.Printf("[%s] evicted %d entries (%d bytes)", d.Kind(), evicted, evictedBytes)
+	}
+	return nil
+}
+
+// removeActions removes the actions that refer to an output. It reports
+// false if one of them was used or rewritten since the scan, or is too
+// recent, in which case the output must be kept.
+func (d *Disk) removeActions(actions []diskEntry, graceStart time.Time) (removed int64, ok bool) {
+	ok = true
+	for _, e := range actions {
+		actionFile := d.actionFile(e.actionID)
+		if e.modTime.After(graceStart) {
+			ok = false
+			continue
+		}
+		if fi, err := os.Stat(actionFile); err != nil || !fi.ModTime().Equal(e.modTime) {
+			// Used or rewritten since the scan.
+			ok = false
+			continue
+		}
+		if err := os.Remove(actionFile); err != nil && !os.IsNotExist(err) {
+			ok = false
+			continue
+		}
+		removed++
+	}
+	return removed, ok
+}
+
+// overLimit reports whether the cache exceeds the given fraction of its limits.
+func (d *Disk) overLimit(bytes, entries int64, fraction float64) bool {
+	if d.opts.MaxBytes > 0 && float64(bytes) > float64(d.opts.MaxBytes)*fraction {
+		return true
+	}
+	if d.opts.MaxEntries > 0 && float64(entries) > float64(d.opts.MaxEntries)*fraction {
+		return true
+	}
+	return false
+}
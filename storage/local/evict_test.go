@@ -0,0 +1,141 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// dataOf returns the size bytes stored by putAged for name.
+func dataOf(name string, size int) []byte {
+	data := []byte(fmt.Sprintf("%*s", size, name))
+	return data[len(data)-size:]
+}
+
+// putAged writes an entry of size bytes that was put and last used age ago.
+func putAged(t *testing.T, d *Disk, name string, size int, age time.Duration) {
+	t.Helper()
+	data := dataOf(name, size)
+	putTime := time.Now().Add(-age)
+	diskPath, err := d.PutAt(context.Background(), actionIDOf(name), outputIDOf(data), int64(size), bytes.NewReader(data), putTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{diskPath, d.actionFile(actionIDOf(name))} {
+		if err := os.Chtimes(file, putTime, putTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// cached returns the names whose entries are still in the cache.
+func cached(t *testing.T, d *Disk, names ...string) []string {
+	t.Helper()
+	var found []string
+	for _, name := range names {
+		outputID, _, _, err := d.Get(context.Background(), actionIDOf(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outputID != "" {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func newLimitedDisk(t *testing.T, opts DiskOptions) *Disk {
+	t.Helper()
+	d := NewDisk(false, t.TempDir(), opts)
+	if err := d.makeShards(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Eviction removes the least recently used entries until the cache is under
+// 90% of its limit, not just under the limit.
+func TestEvictLRU(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{MaxBytes: 95})
+	var names []string
+	for i := range 10 {
+		name := fmt.Sprintf("entry %d", i)
+		putAged(t, d, name, 10, time.Duration(10-i)*time.Hour)
+		names = append(names, name)
+	}
+	if err := d.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(t, d, names...); fmt.Sprint(got) != fmt.Sprint(names[2:]) {
+		t.Errorf("cached = %q, want %q", got, names[2:])
+	}
+	if d.evictions.Load() != 2 || d.evictedBytes.Load() != 20 || d.usedBytes.Load() != 80 {
+		t.Errorf("evicted %d entries, %d bytes, %d bytes used; want 2, 20, 80", d.evictions.Load(), d.evictedBytes.Load(), d.usedBytes.Load())
+	}
+}
+
+func TestEvictMaxEntries(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{MaxEntries: 4})
+	var names []string
+	for i := range 5 {
+		name := fmt.Sprintf("entry %d", i)
+		putAged(t, d, name, 1, time.Duration(5-i)*time.Hour)
+		names = append(names, name)
+	}
+	if err := d.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(t, d, names...); fmt.Sprint(got) != fmt.Sprint(names[2:]) {
+		t.Errorf("cached = %q, want %q", got, names[2:])
+	}
+}
+
+// Entries written within evictGrace are kept even over the limit, since a
+// concurrent put may be about to refer to them.
+func TestEvictGrace(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{MaxBytes: 15})
+	putAged(t, d, "old", 10, time.Hour)
+	putAged(t, d, "recent", 10, evictGrace/2)
+	putAged(t, d, "new", 10, 0)
+	if err := d.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(t, d, "old", "recent", "new"); fmt.Sprint(got) != "[recent new]" {
+		t.Errorf("cached = %q, want [recent new]", got)
+	}
+}
+
+// The cache is only scanned at start and once the usage estimate goes over a
+// limit; a scan resets the estimate to the actual usage.
+func TestEvictScansOverLimit(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{MaxBytes: 100, EvictInterval: time.Millisecond})
+	putAged(t, d, "a", 10, time.Hour)
+	d.usedBytes.Store(0) // measured by the scan at start
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	waitFor(t, func() bool { return d.usedBytes.Load() == 10 })
+
+	d.usedBytes.Store(50) // a wrong estimate under the limit
+	time.Sleep(20 * time.Millisecond)
+	if n := d.usedBytes.Load(); n != 50 {
+		t.Errorf("used bytes = %d, want the estimate 50 since no scan is due", n)
+	}
+	d.usedBytes.Store(200) // a wrong estimate over the limit
+	waitFor(t, func() bool { return d.usedBytes.Load() == 10 })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
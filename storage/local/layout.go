@@ -0,0 +1,132 @@
+package local
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Disk shards its files into 256 subdirectories named after the first byte
+// of their ID, like the go command's cache, so that no directory grows too
+// large. Earlier versions stored every file directly in the cache directory;
+// those are still read and are moved into their shard.
+
+// shard returns the name of the subdirectory for id.
+func shard(id string) string {
+	if len(id) < 2 {
+		return "00"
+	}
+	return id[:2]
+}
+
+func (d *Disk) actionFile(actionID string) string {
+	return filepath.Join(d.dir, shard(actionID), fmt.Sprintf("a-%s", actionID))
+}
+
+func (d *Disk) outputFile(outputID string) string {
+	return filepath.Join(d.dir, shard(outputID), fmt.Sprintf("o-%s", outputID))
+}
+
+// makeShards creates the shard directories.
+func (d *Disk) makeShards() error {
+	for i := range 256 {
+		if err := os.MkdirAll(filepath.Join(d.dir, fmt.Sprintf("%02x", i)), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls fn for every file in the shard directories.
+func (d *Disk) walk(fn func(dir string, de os.DirEntry)) error {
+	for i := range 256 {
+		dir := filepath.Join(d.dir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, de := range dirEntries {
+			fn(dir, de)
+		}
+	}
+	return nil
+}
+
+// hasFlat reports whether the cache directory contains files of the flat layout.
+func (d *Disk) hasFlat() bool {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return false
+	}
+	for _, de := range dirEntries {
+		if _, ok := flatID(de); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flatID returns the ID of a file of the flat layout.
+func flatID(de os.DirEntry) (string, bool) {
+	name := de.Name()
+	if !de.Type().IsRegular() || strings.Contains(name, ".") {
+		return "", false
+	}
+	if id, ok := strings.CutPrefix(name, "a-"); ok {
+		return id, true
+	}
+	if id, ok := strings.CutPrefix(name, "o-"); ok {
+		return id, true
+	}
+	return "", false
+}
+
+// migrateFlat moves every file of the flat layout into its shard. Outputs are
+// moved before actions so that a migrated action never refers to an output
+// that is still in the flat layout.
+func (d *Disk) migrateFlat() error {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range []string{"o-", "a-"} {
+		for _, de := range dirEntries {
+			id, ok := flatID(de)
+			if !ok || !strings.HasPrefix(de.Name(), prefix) {
+				continue
+			}
+			d.migrate(de.Name(), id)
+		}
+	}
+	d.flat.Store(false)
+	return nil
+}
+
+// migrate moves a single file of the flat layout into its shard. Errors are
+// ignored; a concurrent migration may have moved it already.
+func (d *Disk) migrate(name, id string) {
+	_ = os.Rename(filepath.Join(d.dir, name), filepath.Join(d.dir, shard(id), name))
+}
+
+// migrateAction moves an action and its output from the flat layout into
+// their shards, if they are still there.
+func (d *Disk) migrateAction(actionID string) {
+	name := fmt.Sprintf("a-%s", actionID)
+	ij, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return
+	}
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err == nil {
+		if _, err := hex.DecodeString(ie.OutputID); err == nil {
+			d.migrate(fmt.Sprintf("o-%s", ie.OutputID), ie.OutputID)
+		}
+	}
+	d.migrate(name, actionID)
+}
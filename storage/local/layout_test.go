@@ -0,0 +1,88 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// putFlat writes an entry in the flat layout of earlier versions.
+func putFlat(t *testing.T, d *Disk, name string) {
+	t.Helper()
+	data := []byte(name)
+	actionID, outputID := actionIDOf(name), outputIDOf(data)
+	if _, err := d.Put(context.Background(), actionID, outputID, int64(len(data)), strings.NewReader(name)); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{d.actionFile(actionID), d.outputFile(outputID)} {
+		if err := os.Rename(file, filepath.Join(d.dir, filepath.Base(file))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{})
+	actionID, outputID := actionIDOf("a"), outputIDOf([]byte("a"))
+	diskPath, err := d.Put(context.Background(), actionID, outputID, 1, strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(d.dir, outputID[:2], "o-"+outputID); diskPath != want {
+		t.Errorf("output path = %q, want %q", diskPath, want)
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, actionID[:2], "a-"+actionID)); err != nil {
+		t.Errorf("action file not in its shard: %v", err)
+	}
+}
+
+// An entry still in the flat layout is moved into its shard when it is used.
+func TestFlatLayoutGet(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{})
+	putFlat(t, d, "a")
+	d.flat.Store(true)
+
+	if got := cached(t, d, "a"); len(got) != 1 {
+		t.Fatalf("Get missed an entry of the flat layout")
+	}
+	for _, file := range []string{d.actionFile(actionIDOf("a")), d.outputFile(outputIDOf([]byte("a")))} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("not migrated: %v", err)
+		}
+	}
+}
+
+// Start migrates the whole flat layout in the background, leaving the files
+// it does not know about alone.
+func TestFlatLayoutMigration(t *testing.T) {
+	d := newLimitedDisk(t, DiskOptions{})
+	putFlat(t, d, "a")
+	putFlat(t, d, "b")
+	temp := filepath.Join(d.dir, "o-"+outputIDOf([]byte("c"))+".tmp")
+	other := filepath.Join(d.dir, "README")
+	for _, file := range []string{temp, other} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	waitFor(t, func() bool { return !d.flat.Load() })
+
+	if d.hasFlat() {
+		t.Errorf("the flat layout is still there after the migration")
+	}
+	for _, file := range []string{temp, other} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("unrelated file moved: %v", err)
+		}
+	}
+	if got := cached(t, d, "a", "b"); len(got) != 2 {
+		t.Errorf("cached = %q after the migration, want [a b]", got)
+	}
+}
@@ -2,121 +2,157 @@ package local
 
 import (
 	"bytes"
-	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-
-	"golang.org/x/sync/errgroup"
+	"os"
+	"time"
 
 	"github.com/reillywatson/gocache/storage/remote"
 )
 
-// MergeRemote is a storage that is backed by a local storage and a remote storage.
-type MergeRemote struct {
-	localStorage  Storage
-	remoteStorage remote.Storage
-	verbose       bool
-}
+// RemoteMode restricts the operations on the remote storage of NewMergeRemote.
+type RemoteMode int
+
+const (
+	// ReadWrite reads from and writes to the remote storage.
+	ReadWrite RemoteMode = iota
+	// ReadOnly reads from the remote storage but never writes to it, e.g.
+	// for untrusted pull-request builds.
+	ReadOnly
+	// WriteOnly writes to the remote storage but never reads from it, e.g.
+	// for the builds that populate the cache.
+	WriteOnly
+)
 
-var _ Storage = &MergeRemote{}
+func (m RemoteMode) String() string {
+	switch m {
+	case ReadWrite:
+		return "read-write"
+	case ReadOnly:
+		return "read-only"
+	case WriteOnly:
+		return "write-only"
+	default:
+		return fmt.Sprintf("RemoteMode(%d)", int(m))
+	}
+}
 
-func NewMergeRemote(localStorage Storage, remoteStorage remote.Storage, verbose bool) *MergeRemote {
-	return &MergeRemote{
-		localStorage:  localStorage,
-		remoteStorage: remoteStorage,
-		verbose:       verbose,
+// ParseRemoteMode parses "read-write", "read-only" or "write-only".
+func ParseRemoteMode(s string) (RemoteMode, error) {
+	for _, m := range []RemoteMode{ReadWrite, ReadOnly, WriteOnly} {
+		if s == m.String() {
+			return m, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown remote mode %q, expected read-write, read-only or write-only", s)
 }
 
-func (m *MergeRemote) Kind() string {
-	return "merge-remote"
+// MergeRemoteOptions configures how NewMergeRemote and NewChain write to the
+// remote storages.
+type MergeRemoteOptions struct {
+	// Mode restricts the operations on the remote storage.
+	Mode RemoteMode
+	// WriteBehind makes Put return once the object is in the local storage,
+	// and upload it to the remote storage in the background.
+	WriteBehind bool
+	// UploadWorkers is the number of concurrent background uploads.
+	UploadWorkers int
+	// UploadRetries is how many times a failed background upload is retried.
+	UploadRetries int
+	// DrainTimeout is how long Close waits for the queued uploads to complete.
+	DrainTimeout time.Duration
+	// QueueSize is the maximum number of queued uploads. Once it is reached,
+	// Put uploads the object itself.
+	QueueSize int
+	// SkipExisting looks each object up in the remote storage before
+	// uploading it, if the remote storage is a remote.PutSkipper, and skips
+	// the upload if the remote storage already has the same output.
+	SkipExisting bool
 }
 
-func (m *MergeRemote) Start(ctx context.Context) error {
-	err := m.localStorage.Start(ctx)
-	if err != nil {
-		_ = m.localStorage.Close()
-		return fmt.Errorf("local cache start failed: %w", err)
+// Tier returns a tier of the remote storage whose policies follow Mode and
+// WriteBehind.
+func (opts MergeRemoteOptions) Tier(remoteStorage remote.Storage) Tier {
+	tier := Tier{Storage: remoteStorage, Read: ReadThrough, Write: WriteThrough}
+	if opts.WriteBehind {
+		tier.Write = WriteBack
 	}
-	err = m.remoteStorage.Start(ctx)
-	if err != nil {
-		_ = m.remoteStorage.Close()
-		return fmt.Errorf("remote cache start failed: %w", err)
+	switch opts.Mode {
+	case ReadOnly:
+		tier.Write = WriteSkip
+	case WriteOnly:
+		tier.Read = ReadSkip
 	}
+	return tier
+}
 
-	return nil
+// NewMergeRemote creates a Chain of the local storage and a single remote
+// storage. Gets are served by the local storage, then by the remote storage;
+// puts write to the local storage, then upload the object to the remote
+// storage from the local file, which the remote can seek to retry.
+func NewMergeRemote(localStorage Storage, remoteStorage remote.Storage, opts MergeRemoteOptions, verbose bool) *Chain {
+	return NewChain(localStorage, []Tier{opts.Tier(remoteStorage)}, opts, verbose)
 }
 
-func (m *MergeRemote) Get(ctx context.Context, actionID string) (string, string, error) {
-	localOutputID, localDiskPath, localErr := m.localStorage.Get(ctx, actionID)
-	if localErr == nil && localOutputID != "" {
-		return localOutputID, localDiskPath, nil
-	}
+// timedStorage is implemented by the local storages that can record the put
+// time of an object, such as Disk.
+type timedStorage interface {
+	PutAt(ctx context.Context, actionID, outputID string, size int64, body io.Reader, putTime time.Time) (string, error)
+}
 
-	remoteOutputID, _, _, remoteErr := m.remoteStorage.Get(ctx, actionID)
-	if remoteErr == nil && remoteOutputID != "" {
-		return remoteOutputID, localDiskPath, nil
+// backfill writes an object read from a remote storage to the local storage.
+// The remote put time is kept, so that the go command sees the same time
+// whether the object is served from the remote or, later, from the disk.
+func backfill(ctx context.Context, localStorage Storage, actionID, outputID string, size int64, body io.Reader, putTime time.Time) (string, error) {
+	if s, ok := localStorage.(timedStorage); ok && !putTime.IsZero() {
+		return s.PutAt(ctx, actionID, outputID, size, body, putTime)
 	}
-
-	// not found
-	return "", "", cmp.Or(localErr, remoteErr)
+	return localStorage.Put(ctx, actionID, outputID, size, body)
 }
 
-// Put writes the data to the remote cache and local cache.
-func (m *MergeRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
-	// 2. write pw from remote cache in remoteStorage.Put and then read it from pr, write it to local disk in localStorage.Put.
-	pr, pw := io.Pipe()
-
-	wg, _ := errgroup.WithContext(ctx)
-	wg.Go(func() error {
-		var putBody io.Reader = pr
-		if size == 0 {
-			putBody = bytes.NewReader(nil)
+// uploadFile uploads an object to the remote storage from its file in the
+// local storage. With skipExisting, the upload is skipped if the remote
+// storage already has the object; if the lookup fails, it is uploaded. It
+// returns remote.ErrBreakerOpen if the remote storage skipped the upload.
+func uploadFile(ctx context.Context, remoteStorage remote.Storage, actionID, outputID string, size int64, diskPath string, skipExisting bool) error {
+	if s, ok := remoteStorage.(remote.PutSkipper); ok && skipExisting {
+		skip, err := s.SkipPut(ctx, actionID, outputID, size)
+		if skip || errors.Is(err, remote.ErrBreakerOpen) {
+			return err
 		}
-		var localErr error
-		diskPath, localErr = m.localStorage.Put(ctx, actionID, outputID, size, putBody)
-		return localErr
-	})
-
-	var putBody io.Reader
+	}
 	if size == 0 {
 		// Special case the empty file so NewRequest sets "Content-Length: 0",
 		// as opposed to thinking we didn't set it and not being able to sniff its size
 		// from the type.
-		putBody = bytes.NewReader(nil)
-	} else {
-		// 1. read putBody in remoteStorage.Put and then write to pw.
-		putBody = io.TeeReader(body, pw)
+		return remoteStorage.Put(ctx, actionID, outputID, size, bytes.NewReader(nil))
 	}
-
-	if err := m.remoteStorage.Put(ctx, actionID, outputID, size, putBody); err != nil {
-		return "", err
-	}
-
-	_ = pw.Close()
-	if err := wg.Wait(); err != nil {
-		log.Printf("[%s] error: %v", m.localStorage.Kind(), err)
-		return "", err
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return err
 	}
-	return diskPath, nil
+	defer f.Close()
+	return remoteStorage.Put(ctx, actionID, outputID, size, f)
+}
 
+// sizeCheckReader fails the read once the underlying reader delivers a
+// different number of bytes than the remote reported.
+type sizeCheckReader struct {
+	r    io.Reader
+	size int64
+	n    int64
 }
 
-func (m *MergeRemote) Close() error {
-	var errAll error
-	if err := m.localStorage.Close(); err != nil {
-		errAll = errors.Join(fmt.Errorf("local cache close failed: %w", err), errAll)
+func (s *sizeCheckReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if s.n > s.size {
+		return n, fmt.Errorf("remote object is larger than the reported %d bytes", s.size)
 	}
-	if err := m.remoteStorage.Close(); err != nil {
-		errAll = errors.Join(fmt.Errorf("remote cache close failed: %w", err), errAll)
+	if err == io.EOF && s.n != s.size {
+		return n, fmt.Errorf("remote object is %d bytes, expected %d: %w", s.n, s.size, io.ErrUnexpectedEOF)
 	}
-
-	return errAll
-}
-
-func (m *MergeRemote) Summary() string {
-	return fmt.Sprintf("\n%s\n%s", m.localStorage.Summary(), m.remoteStorage.Summary())
+	return n, err
 }
@@ -0,0 +1,85 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// A remote hit is written to the local disk, which serves the next gets.
+func TestMergeRemoteBackfill(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDisk(t)
+	mem := remote.NewMemory(1<<20, false)
+	putMemory(t, mem, actionIDOf("a"), []byte("remote"))
+	c := NewMergeRemote(disk, mem, MergeRemoteOptions{}, false)
+	startChain(t, c)
+
+	getChain(t, c, actionIDOf("a"), []byte("remote"))
+	getChain(t, c, actionIDOf("a"), []byte("remote"))
+	if n := mem.Count.Gets.Load(); n != 1 {
+		t.Errorf("remote gets = %d, want 1 since the disk was backfilled", n)
+	}
+	if outputID, _, _, err := disk.Get(ctx, actionIDOf("a")); err != nil || outputID != outputIDOf([]byte("remote")) {
+		t.Errorf("disk Get = %q, %v; want the backfilled object", outputID, err)
+	}
+}
+
+// datedRemote is a remote storage whose objects were all put at putTime.
+type datedRemote struct {
+	*remote.Memory
+	putTime time.Time
+}
+
+func (r datedRemote) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	outputID, size, _, body, err := r.Memory.Get(ctx, actionID)
+	return outputID, size, r.putTime, body, err
+}
+
+// A backfilled object keeps the time it was put in the remote storage, not
+// the time it was copied to the local disk.
+func TestMergeRemoteBackfillPutTime(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDisk(t)
+	mem := remote.NewMemory(1<<20, false)
+	putMemory(t, mem, actionIDOf("a"), []byte("remote"))
+	putTime := time.Now().Add(-time.Hour)
+	c := NewMergeRemote(disk, datedRemote{mem, putTime}, MergeRemoteOptions{}, false)
+	startChain(t, c)
+
+	if _, _, got, err := c.Get(ctx, actionIDOf("a")); err != nil || !got.Equal(putTime) {
+		t.Errorf("Get put time = %v, %v; want %v", got, err, putTime)
+	}
+	if _, _, got, err := disk.Get(ctx, actionIDOf("a")); err != nil || !got.Equal(putTime) {
+		t.Errorf("disk Get put time = %v, %v; want %v", got, err, putTime)
+	}
+}
+
+// shortRemote is a remote storage whose objects are shorter than it reports.
+type shortRemote struct {
+	*remote.Memory
+}
+
+func (s shortRemote) Get(context.Context, string) (string, int64, time.Time, io.ReadCloser, error) {
+	return outputIDOf([]byte("remote")), 6, time.Now(), io.NopCloser(bytes.NewReader([]byte("rem"))), nil
+}
+
+// A remote object that is not the reported size fails the get, and is not
+// written to the local disk.
+func TestMergeRemoteBackfillShortBody(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDisk(t)
+	c := NewMergeRemote(disk, shortRemote{remote.NewMemory(1<<20, false)}, MergeRemoteOptions{}, false)
+	startChain(t, c)
+
+	if outputID, _, _, err := c.Get(ctx, actionIDOf("a")); err == nil {
+		t.Errorf("Get = %q, want an error", outputID)
+	}
+	if outputID, _, _, err := disk.Get(ctx, actionIDOf("a")); err != nil || outputID != "" {
+		t.Errorf("disk Get = %q, %v; want a miss", outputID, err)
+	}
+}
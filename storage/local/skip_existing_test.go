@@ -0,0 +1,92 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// skipperRemote is a remote storage that can look up its objects, or fails
+// the lookups with err if it is set.
+type skipperRemote struct {
+	*remote.Memory
+	err     error
+	lookups int
+}
+
+func (r *skipperRemote) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	r.lookups++
+	if r.err != nil {
+		return false, r.err
+	}
+	storedID, storedSize, _, body, err := r.Memory.Get(ctx, actionID)
+	if err != nil || body == nil {
+		return false, err
+	}
+	_ = body.Close()
+	return storedID == outputID && storedSize == size, nil
+}
+
+func TestUploadFileSkipExisting(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("data")
+	diskPath := filepath.Join(t.TempDir(), "o")
+	if err := os.WriteFile(diskPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name         string
+		skipExisting bool
+		stored       []byte
+		lookupErr    error
+		lookups      int
+		uploaded     bool
+		err          error
+	}{
+		{"stored", true, data, nil, 1, false, nil},
+		{"missing", true, nil, nil, 1, true, nil},
+		{"other output", true, []byte("other"), nil, 1, true, nil},
+		{"lookup failed", true, data, errors.New("timeout"), 1, true, nil},
+		{"breaker open", true, data, remote.ErrBreakerOpen, 1, false, remote.ErrBreakerOpen},
+		{"disabled", false, data, nil, 0, true, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &skipperRemote{Memory: remote.NewMemory(1<<20, false), err: tt.lookupErr}
+			if tt.stored != nil {
+				putMemory(t, r.Memory, actionIDOf("a"), tt.stored)
+			}
+			puts := r.Count.Puts.Load()
+			err := uploadFile(ctx, r, actionIDOf("a"), outputIDOf(data), int64(len(data)), diskPath, tt.skipExisting)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("uploadFile = %v, want %v", err, tt.err)
+			}
+			if uploaded := r.Count.Puts.Load() > puts; uploaded != tt.uploaded || r.lookups != tt.lookups {
+				t.Errorf("uploaded = %v after %d lookups, want %v after %d", uploaded, r.lookups, tt.uploaded, tt.lookups)
+			}
+		})
+	}
+}
+
+// A chain with SkipExisting does not upload again the objects that its tiers
+// already store.
+func TestChainSkipExisting(t *testing.T) {
+	ctx := context.Background()
+	r := &skipperRemote{Memory: remote.NewMemory(1<<20, false)}
+	putMemory(t, r.Memory, actionIDOf("a"), []byte("data"))
+	c := NewMergeRemote(newTestDisk(t), r, MergeRemoteOptions{SkipExisting: true}, false)
+	startChain(t, c)
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := c.Put(ctx, actionIDOf(name), outputIDOf([]byte("data")), 4, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.Count.Puts.Load(); n != 2 {
+		t.Errorf("remote puts = %d, want 2: the initial one and b", n)
+	}
+}
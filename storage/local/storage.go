@@ -3,12 +3,17 @@ package local
 import (
 	"context"
 	"io"
+	"time"
 )
 
 type Storage interface {
 	Kind() string
 	Start(ctx context.Context) error
-	Get(ctx context.Context, actionID string) (outputID, diskPath string, err error)
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, putTime time.Time, err error)
+	// Put stores the object and returns the path of its file on disk. The
+	// body is streamed from the input of the process, and no other request
+	// can be parsed until it has been read, so Put must consume it before
+	// any call to a remote storage, e.g. by writing it to disk first.
 	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error)
 	Close() error
 	Summary() string
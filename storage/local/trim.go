@@ -0,0 +1,146 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// trimFile records the time of the last completed trim, like the go command's cache.
+	trimFile = "trim.txt"
+	// trimLockFile is held while a trim is in progress, so that only one of
+	// the processes sharing the directory trims it.
+	trimLockFile = "trim.lock"
+	// trimLockStale is how old a lock must be before it is considered abandoned.
+	trimLockStale = time.Hour
+)
+
+// trimDue reports whether the last trim recorded in the directory is older
+// than the trim interval. A missing or corrupt trim file, or one too far in
+// the future, means a trim is due.
+func (d *Disk) trimDue(now time.Time) bool {
+	data, err := os.ReadFile(filepath.Join(d.dir, trimFile))
+	if err != nil {
+		return true
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return true
+	}
+	last := time.Unix(sec, 0)
+	return now.Sub(last) >= d.opts.TrimInterval || last.After(now.Add(d.opts.TrimInterval))
+}
+
+// lockTrim takes the trim lock of the directory. It reports false if another
+// process holds it.
+func (d *Disk) lockTrim() (unlock func(), ok bool, err error) {
+	lockFile := filepath.Join(d.dir, trimLockFile)
+	for range 2 {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(lockFile) }, true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, false, err
+		}
+		fi, err := os.Stat(lockFile)
+		if err != nil || time.Since(fi.ModTime()) < trimLockStale {
+			return nil, false, nil
+		}
+		// The process holding the lock probably died.
+		_ = os.Remove(lockFile)
+	}
+	return nil, false, nil
+}
+
+// trim removes the entries that have not been used for the trim age, at most
+// once per trim interval across all processes sharing the directory.
+func (d *Disk) trim() error {
+	now := time.Now()
+	if !d.trimDue(now) {
+		return nil
+	}
+	unlock, ok, err := d.lockTrim()
+	if err != nil {
+		return fmt.Errorf("[%s] trim lock failed: %w", d.Kind(), err)
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+	// Another process may have finished a trim before we took the lock.
+	if !d.trimDue(now) {
+		return nil
+	}
+
+	entries, err := d.scan()
+	if err != nil {
+		return fmt.Errorf("[%s] trim scan failed: %w", d.Kind(), err)
+	}
+	cutoff := now.Add(-d.opts.TrimAge)
+	refs := make(map[string]bool)
+	var trimmed, trimmedBytes int64
+	for _, e := range entries {
+		actionFile := d.actionFile(e.actionID)
+		if !e.lastUsed.Before(cutoff) {
+			refs[e.OutputID] = true
+			continue
+		}
+		if fi, err := os.Stat(actionFile); err != nil || !fi.ModTime().Equal(e.modTime) {
+			refs[e.OutputID] = true
+			continue
+		}
+		if err := os.Remove(actionFile); err != nil && !os.IsNotExist(err) {
+			refs[e.OutputID] = true
+			continue
+		}
+		trimmed++
+	}
+
+	// Remove the outputs that are no longer referenced, along with temporary
+	// files left behind by crashed writers.
+	err = d.walk(func(dir string, de os.DirEntry) {
+		name := de.Name()
+		switch {
+		case strings.Contains(name, "."):
+			if !strings.HasPrefix(name, "o-") && !strings.HasPrefix(name, "a-") {
+				return
+			}
+		case strings.HasPrefix(name, "o-"):
+			if refs[strings.TrimPrefix(name, "o-")] {
+				return
+			}
+		default:
+			return
+		}
+		fi, err := de.Info()
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			return
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err == nil && strings.HasPrefix(name, "o-") {
+			trimmedBytes += fi.Size()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("[%s] trim scan failed: %w", d.Kind(), err)
+	}
+
+	if _, err := writeAtomic(filepath.Join(d.dir, trimFile), strings.NewReader(fmt.Sprintf("%d", now.Unix()))); err != nil {
+		return fmt.Errorf("[%s] trim failed to record time: %w", d.Kind(), err)
+	}
+	d.usedEntries.Add(-trimmed)
+	d.usedBytes.Add(-trimmedBytes)
+	d.trimmed.Add(trimmed)
+	d.trimmedBytes.Add(trimmedBytes)
+	if d.verbose {
+		log.Printf("[%s] trimmed %d entries (%d bytes) unused since %s", d.Kind(), trimmed, trimmedBytes, cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
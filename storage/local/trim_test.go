@@ -0,0 +1,102 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTrimDisk(t *testing.T) *Disk {
+	t.Helper()
+	d := newLimitedDisk(t, DiskOptions{TrimAge: 24 * time.Hour})
+	putAged(t, d, "unused", 10, 48*time.Hour)
+	putAged(t, d, "used", 10, time.Hour)
+	return d
+}
+
+func writeTrimFile(t *testing.T, d *Disk, name string, data string, mtime time.Time) {
+	t.Helper()
+	file := filepath.Join(d.dir, name)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A trim removes the entries unused for the trim age, along with their
+// outputs, and records its time.
+func TestTrim(t *testing.T) {
+	d := newTrimDisk(t)
+	unusedOutput := d.outputFile(outputIDOf(dataOf("unused", 10)))
+	if err := d.trim(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(t, d, "unused", "used"); fmt.Sprint(got) != "[used]" {
+		t.Errorf("cached = %q, want [used]", got)
+	}
+	if _, err := os.Stat(unusedOutput); !os.IsNotExist(err) {
+		t.Errorf("output of the trimmed entry: %v, want it removed", err)
+	}
+	if d.trimmed.Load() != 1 || d.trimmedBytes.Load() != 10 {
+		t.Errorf("trimmed %d entries, %d bytes; want 1, 10", d.trimmed.Load(), d.trimmedBytes.Load())
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, trimFile)); err != nil {
+		t.Errorf("trim time not recorded: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, trimLockFile)); !os.IsNotExist(err) {
+		t.Errorf("trim lock: %v, want it released", err)
+	}
+}
+
+func TestTrimNotDue(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name     string
+		lastTrim time.Time
+		trimmed  bool
+	}{
+		{"recent", now.Add(-time.Hour), false},
+		{"old", now.Add(-25 * time.Hour), true},
+		{"future", now.Add(48 * time.Hour), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTrimDisk(t)
+			writeTrimFile(t, d, trimFile, fmt.Sprint(tt.lastTrim.Unix()), now)
+			if err := d.trim(); err != nil {
+				t.Fatal(err)
+			}
+			if trimmed := d.trimmed.Load() > 0; trimmed != tt.trimmed {
+				t.Errorf("trimmed = %v, want %v", trimmed, tt.trimmed)
+			}
+		})
+	}
+}
+
+// Only one of the processes sharing a directory trims it, unless the one
+// holding the lock seems to have died.
+func TestTrimLocked(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name     string
+		lockTime time.Time
+		trimmed  bool
+	}{
+		{"held", now, false},
+		{"stale", now.Add(-2 * trimLockStale), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTrimDisk(t)
+			writeTrimFile(t, d, trimLockFile, "", tt.lockTime)
+			if err := d.trim(); err != nil {
+				t.Fatal(err)
+			}
+			if trimmed := d.trimmed.Load() > 0; trimmed != tt.trimmed {
+				t.Errorf("trimmed = %v, want %v", trimmed, tt.trimmed)
+			}
+		})
+	}
+}
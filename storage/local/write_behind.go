@@ -0,0 +1,202 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// uploadJob is an object written to the local cache that is waiting to be
+// uploaded to the remote cache.
+type uploadJob struct {
+	actionID string
+	outputID string
+	size     int64
+	diskPath string
+}
+
+// uploader uploads objects to the remote cache in the background, from the
+// files of the local cache.
+type uploader struct {
+	name          string
+	remoteStorage remote.Storage
+	opts          MergeRemoteOptions
+	verbose       bool
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []uploadJob
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	uploaded  atomic.Int64
+	failed    atomic.Int64
+	abandoned atomic.Int64
+	skipped   atomic.Int64 // by an open breaker
+	missing   atomic.Int64 // evicted or trimmed from the local cache before the upload
+	overflow  atomic.Int64 // uploaded by Put as the queue was full
+}
+
+func newUploader(remoteStorage remote.Storage, opts MergeRemoteOptions, verbose bool) *uploader {
+	u := &uploader{
+		name:          "write-behind",
+		remoteStorage: remoteStorage,
+		opts:          opts,
+		verbose:       verbose,
+	}
+	u.cond = sync.NewCond(&u.mu)
+	return u
+}
+
+func (u *uploader) kind() string {
+	return u.name
+}
+
+// start starts the workers. Uploads outlive the requests that queued them,
+// so they are only canceled by close.
+func (u *uploader) start(ctx context.Context) {
+	u.ctx, u.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	for range u.opts.UploadWorkers {
+		u.wg.Add(1)
+		go u.work()
+	}
+}
+
+// enqueue queues the upload of job. It reports false if the queue is full,
+// in which case the caller uploads the object itself.
+func (u *uploader) enqueue(job uploadJob) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		u.abandoned.Add(1)
+		return true
+	}
+	if len(u.queue) >= u.opts.QueueSize {
+		u.overflow.Add(1)
+		return false
+	}
+	u.queue = append(u.queue, job)
+	u.cond.Signal()
+	return true
+}
+
+func (u *uploader) work() {
+	defer u.wg.Done()
+	for {
+		u.mu.Lock()
+		for len(u.queue) == 0 && !u.closed {
+			u.cond.Wait()
+		}
+		if len(u.queue) == 0 {
+			u.mu.Unlock()
+			return
+		}
+		job := u.queue[0]
+		u.queue = u.queue[1:]
+		u.mu.Unlock()
+
+		u.upload(job)
+	}
+}
+
+// upload uploads a single object, retrying with exponential backoff. Objects
+// that are no longer in the local cache, or that an open breaker skips, are
+// not retried.
+func (u *uploader) upload(job uploadJob) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := u.put(job)
+		if err == nil {
+			u.uploaded.Add(1)
+			return
+		}
+		if errors.Is(err, remote.ErrBreakerOpen) {
+			u.skipped.Add(1)
+			return
+		}
+		if _, statErr := os.Stat(job.diskPath); os.IsNotExist(statErr) {
+			u.missing.Add(1)
+			if u.verbose {
+				log.Printf("[%s] upload of %s dropped, no longer in the local cache", u.kind(), job.actionID)
+			}
+			return
+		}
+		if u.ctx.Err() != nil {
+			u.abandoned.Add(1)
+			return
+		}
+		if attempt >= u.opts.UploadRetries {
+			u.failed.Add(1)
+			log.Printf("[%s] upload of %s failed after %d attempts: %v", u.kind(), job.actionID, attempt+1, err)
+			return
+		}
+		select {
+		case <-u.ctx.Done():
+			u.abandoned.Add(1)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+func (u *uploader) put(job uploadJob) error {
+	return uploadFile(u.ctx, u.remoteStorage, job.actionID, job.outputID, job.size, job.diskPath, u.opts.SkipExisting)
+}
+
+// close waits up to the drain timeout for the queued uploads to complete,
+// then abandons the rest.
+func (u *uploader) close() {
+	u.mu.Lock()
+	u.closed = true
+	pending := len(u.queue)
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	if u.verbose && pending > 0 {
+		log.Printf("[%s] draining %d queued uploads", u.kind(), pending)
+	}
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(u.opts.DrainTimeout):
+		u.mu.Lock()
+		u.abandoned.Add(int64(len(u.queue)))
+		u.queue = nil
+		u.mu.Unlock()
+		u.cancel()
+		<-done
+	}
+	u.cancel()
+	if n := u.abandoned.Load(); n > 0 {
+		log.Printf("Warning: [%s] %d uploads abandoned on close", u.kind(), n)
+	}
+}
+
+func (u *uploader) summary() string {
+	summary := fmt.Sprintf("[%s] %d uploaded, %d failed, %d abandoned", u.kind(), u.uploaded.Load(), u.failed.Load(), u.abandoned.Load())
+	if n := u.skipped.Load(); n > 0 {
+		summary += fmt.Sprintf(", %d skipped by the breaker", n)
+	}
+	if n := u.missing.Load(); n > 0 {
+		summary += fmt.Sprintf(", %d dropped from the local cache", n)
+	}
+	if n := u.overflow.Load(); n > 0 {
+		summary += fmt.Sprintf(", %d sent in the foreground as the queue was full", n)
+	}
+	return summary
+}
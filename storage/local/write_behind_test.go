@@ -0,0 +1,154 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// flakyRemote is a remote storage whose puts fail until failures runs out,
+// and block until unblock is closed if it is set.
+type flakyRemote struct {
+	*remote.Memory
+	failures atomic.Int64
+	attempts atomic.Int64
+	err      error
+	unblock  chan struct{}
+}
+
+func newFlakyRemote(failures int64) *flakyRemote {
+	r := &flakyRemote{Memory: remote.NewMemory(1<<20, false), err: errors.New("upload failed")}
+	r.failures.Store(failures)
+	return r
+}
+
+func (r *flakyRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	r.attempts.Add(1)
+	if r.unblock != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.unblock:
+		}
+	}
+	if r.failures.Add(-1) >= 0 {
+		return r.err
+	}
+	return r.Memory.Put(ctx, actionID, outputID, size, body)
+}
+
+// newJob writes an object to a file, and returns the job uploading it.
+func newJob(t *testing.T, name string) uploadJob {
+	t.Helper()
+	diskPath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(diskPath, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return uploadJob{actionID: actionIDOf(name), outputID: outputIDOf([]byte(name)), size: int64(len(name)), diskPath: diskPath}
+}
+
+func startUploader(r remote.Storage, opts MergeRemoteOptions) *uploader {
+	u := newUploader(r, opts, false)
+	u.start(context.Background())
+	return u
+}
+
+// Once the queue is full, the caller has to upload the object itself.
+func TestUploaderQueueSize(t *testing.T) {
+	u := newUploader(newFlakyRemote(0), MergeRemoteOptions{QueueSize: 2}, false)
+	for i, want := range []bool{true, true, false} {
+		if got := u.enqueue(newJob(t, "a")); got != want {
+			t.Errorf("enqueue %d = %v, want %v", i, got, want)
+		}
+	}
+	if n := u.overflow.Load(); n != 1 {
+		t.Errorf("overflow = %d, want 1", n)
+	}
+}
+
+func TestUploaderRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int64
+		uploaded bool
+	}{
+		{"success after retries", 2, true},
+		{"failure after retries", 3, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFlakyRemote(tt.failures)
+			u := startUploader(r, MergeRemoteOptions{UploadWorkers: 1, UploadRetries: 2, QueueSize: 1, DrainTimeout: time.Minute})
+			u.enqueue(newJob(t, "a"))
+			u.close()
+			if n := r.attempts.Load(); n != 3 {
+				t.Errorf("attempts = %d, want 3", n)
+			}
+			if u.uploaded.Load() == 1 != tt.uploaded || u.failed.Load() == 1 == tt.uploaded {
+				t.Errorf("uploaded %d, failed %d; want uploaded: %v", u.uploaded.Load(), u.failed.Load(), tt.uploaded)
+			}
+		})
+	}
+}
+
+// An upload is not retried once the object is gone from the local cache, or
+// while the breaker is open.
+func TestUploaderNoRetry(t *testing.T) {
+	r := newFlakyRemote(10)
+	u := startUploader(r, MergeRemoteOptions{UploadWorkers: 1, UploadRetries: 2, QueueSize: 2, DrainTimeout: time.Minute})
+	job := newJob(t, "evicted")
+	if err := os.Remove(job.diskPath); err != nil {
+		t.Fatal(err)
+	}
+	u.enqueue(job)
+	u.close()
+
+	r = newFlakyRemote(10)
+	r.err = remote.ErrBreakerOpen
+	u2 := startUploader(r, MergeRemoteOptions{UploadWorkers: 1, UploadRetries: 2, QueueSize: 2, DrainTimeout: time.Minute})
+	u2.enqueue(newJob(t, "open"))
+	u2.close()
+
+	if u.missing.Load() != 1 || u2.skipped.Load() != 1 || r.attempts.Load() != 1 {
+		t.Errorf("missing %d, skipped %d, attempts %d; want 1, 1, 1", u.missing.Load(), u2.skipped.Load(), r.attempts.Load())
+	}
+}
+
+// close waits for the queued uploads, up to the drain timeout.
+func TestUploaderDrain(t *testing.T) {
+	r := newFlakyRemote(0)
+	u := startUploader(r, MergeRemoteOptions{UploadWorkers: 1, QueueSize: 10, DrainTimeout: time.Minute})
+	for _, name := range []string{"a", "b", "c"} {
+		u.enqueue(newJob(t, name))
+	}
+	u.close()
+	if n := u.uploaded.Load(); n != 3 {
+		t.Errorf("uploaded = %d after close, want 3", n)
+	}
+	if !u.enqueue(newJob(t, "late")) || u.abandoned.Load() != 1 {
+		t.Errorf("a put after close was not abandoned")
+	}
+}
+
+func TestUploaderDrainTimeout(t *testing.T) {
+	r := newFlakyRemote(0)
+	r.unblock = make(chan struct{})
+	u := startUploader(r, MergeRemoteOptions{UploadWorkers: 1, QueueSize: 10, DrainTimeout: 10 * time.Millisecond})
+	for _, name := range []string{"a", "b", "c"} {
+		u.enqueue(newJob(t, name))
+	}
+	start := time.Now()
+	u.close()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("close took %v, want about the drain timeout", d)
+	}
+	if u.uploaded.Load() != 0 || u.abandoned.Load() != 3 {
+		t.Errorf("uploaded %d, abandoned %d; want 0, 3", u.uploaded.Load(), u.abandoned.Load())
+	}
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/reillywatson/gocache/storage/local"
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+// errInvalidRemote is returned for remote cache configurations that can never
+// work, such as unknown schemes or conflicting options.
+var errInvalidRemote = errors.New("invalid remote cache configuration")
+
+// RemoteConstructor creates the remote cache of a URL. The URL options take
+// precedence over, but must not conflict with, the provider options in opts.
+type RemoteConstructor func(ctx context.Context, u *url.URL, opts Options) (remote.Storage, error)
+
+var remoteConstructors = map[string]RemoteConstructor{
+	"s3":     newAmazonS3Remote,
+	"gs":     newGoogleCloudStorageRemote,
+	"azblob": newAzureBlobRemote,
+	"http":   newHTTPRemote,
+	"https":  newHTTPRemote,
+	"grpc":   newREAPIRemote,
+	"grpcs":  newREAPIRemote,
+	"redis":  newRedisRemote,
+	"rediss": newRedisRemote,
+	"file":   newSharedDirRemote,
+	"oci":    newOCIRemote,
+	"gha":    newGitHubActionsRemote,
+	"mem":    newMemoryRemote,
+}
+
+// RegisterRemote registers the constructor of the remote caches of the URLs
+// with the scheme, replacing any constructor registered before.
+func RegisterRemote(scheme string, constructor RemoteConstructor) {
+	remoteConstructors[scheme] = constructor
+}
+
+// newRemote creates the remote cache configured in opts, or returns nil if
+// there is none.
+func newRemote(ctx context.Context, opts Options) (remote.Storage, error) {
+	u, err := remoteURL(opts)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return constructRemote(ctx, u, opts)
+}
+
+// constructRemote creates the remote cache of a URL with the constructor
+// registered for its scheme, bounded by the deadlines and the breaker of opts.
+func constructRemote(ctx context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	constructor, ok := remoteConstructors[u.Scheme]
+	if !ok {
+		schemes := slices.Sorted(maps.Keys(remoteConstructors))
+		return nil, fmt.Errorf("%w: unknown scheme %q, expected one of %s", errInvalidRemote, u.Scheme, strings.Join(schemes, ", "))
+	}
+	remoteStorage, err := constructor(ctx, u, opts)
+	if err != nil || !opts.Breaker.Enabled() {
+		return remoteStorage, err
+	}
+	return remote.NewBreaker(remoteStorage, opts.Breaker, opts.Verbose), nil
+}
+
+// remoteURL returns the URL of the remote cache configured in opts. The
+// provider options such as S3Bucket are shorthands for a URL.
+func remoteURL(opts Options) (*url.URL, error) {
+	var names []string
+	var u *url.URL
+	add := func(name, rawURL string) error {
+		names = append(names, name)
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errInvalidRemote, name, err)
+		}
+		if parsed.Scheme == "" {
+			return fmt.Errorf("%w: %s: missing scheme in %q", errInvalidRemote, name, rawURL)
+		}
+		u = parsed
+		return nil
+	}
+
+	var err error
+	if opts.RemoteURL != "" {
+		err = errors.Join(err, add("--remote", opts.RemoteURL))
+	}
+	if opts.S3Bucket != "" {
+		err = errors.Join(err, add("--s3-bucket", "s3://"+opts.S3Bucket))
+	}
+	if opts.GCSBucket != "" {
+		err = errors.Join(err, add("--gcs-bucket", "gs://"+opts.GCSBucket))
+	}
+	if opts.HTTPURL != "" {
+		err = errors.Join(err, add("--http-url", opts.HTTPURL))
+	}
+	if opts.REAPITarget != "" {
+		names = append(names, "--reapi")
+		u = &url.URL{Scheme: "grpc", Host: opts.REAPITarget}
+	}
+	if opts.RedisURL != "" {
+		err = errors.Join(err, add("--redis", opts.RedisURL))
+	}
+	if opts.AzureContainer != "" {
+		err = errors.Join(err, add("--azure-container", "azblob://"+opts.AzureContainer))
+	}
+	if opts.SharedDir != "" {
+		names = append(names, "--shared-dir")
+		u = &url.URL{Scheme: "file", Path: opts.SharedDir}
+	}
+	if opts.OCIRepository != "" {
+		err = errors.Join(err, add("--oci-repository", "oci://"+opts.OCIRepository))
+	}
+	if opts.GitHubActions {
+		names = append(names, "--github-actions")
+		u = &url.URL{Scheme: "gha"}
+	}
+
+	if len(names) > 1 {
+		return nil, fmt.Errorf("%w: conflicting options %s, only one remote cache can be used", errInvalidRemote, strings.Join(names, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// newTier creates a tier of a chain from a URL. The read and write options of
+// the URL set the policies of the tier; the others are passed to the remote.
+// Memory tiers are fast, so the leading ones are ahead of the local disk.
+func newTier(ctx context.Context, rawURL string, opts Options) (local.Tier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return local.Tier{}, fmt.Errorf("%w: --tier: %v", errInvalidRemote, err)
+	}
+	if u.Scheme == "" {
+		return local.Tier{}, fmt.Errorf("%w: --tier: missing scheme in %q", errInvalidRemote, rawURL)
+	}
+	tier := opts.Remote.Tier(nil)
+	tier.Fast = u.Scheme == "mem"
+	query := u.Query()
+	if query.Has("read") {
+		if tier.Read, err = local.ParseReadPolicy(query.Get("read")); err != nil {
+			return local.Tier{}, fmt.Errorf("%w: --tier %s: %v", errInvalidRemote, rawURL, err)
+		}
+	}
+	if query.Has("write") {
+		if tier.Write, err = local.ParseWritePolicy(query.Get("write")); err != nil {
+			return local.Tier{}, fmt.Errorf("%w: --tier %s: %v", errInvalidRemote, rawURL, err)
+		}
+	}
+	// --remote-mode caps the policies of every tier, whatever the query says.
+	if opts.Remote.Mode == local.ReadOnly && tier.Write != local.WriteSkip || opts.Remote.Mode == local.WriteOnly && tier.Read != local.ReadSkip {
+		return local.Tier{}, fmt.Errorf("%w: --tier %s: %s, %s conflicts with --remote-mode=%s", errInvalidRemote, rawURL, tier.Read, tier.Write, opts.Remote.Mode)
+	}
+	query.Del("read")
+	query.Del("write")
+	u.RawQuery = query.Encode()
+
+	tier.Storage, err = constructRemote(ctx, u, opts)
+	return tier, err
+}
+
+// remoteQuery reads the options in the query of a remote URL.
+type remoteQuery struct {
+	u      *url.URL
+	values url.Values
+	err    error
+}
+
+func newRemoteQuery(u *url.URL) *remoteQuery {
+	return &remoteQuery{u: u, values: u.Query()}
+}
+
+// fail records the first error. The URL is reported without its query, as
+// the values of unknown options may be secrets.
+func (q *remoteQuery) fail(format string, args ...any) {
+	if q.err == nil {
+		u := *q.u
+		u.RawQuery = ""
+		q.err = fmt.Errorf("%w: %s: %s", errInvalidRemote, u.Redacted(), fmt.Sprintf(format, args...))
+	}
+}
+
+// string sets *dst to the value of the option, if it is set. It fails if *dst
+// was set to a different value by a flag.
+func (q *remoteQuery) string(name string, dst *string) {
+	if !q.values.Has(name) {
+		return
+	}
+	value := q.values.Get(name)
+	q.values.Del(name)
+	if *dst != "" && *dst != value {
+		q.fail("option %s=%s conflicts with the flag value %s", name, value, *dst)
+		return
+	}
+	*dst = value
+}
+
+// bool sets *dst to the value of the option, if it is set. An option without
+// a value is true.
+func (q *remoteQuery) bool(name string, dst *bool) {
+	if !q.values.Has(name) {
+		return
+	}
+	value := q.values.Get(name)
+	q.values.Del(name)
+	b := true
+	if value != "" {
+		var err error
+		if b, err = strconv.ParseBool(value); err != nil {
+			q.fail("option %s=%s is not a boolean", name, value)
+			return
+		}
+	}
+	if *dst && !b {
+		q.fail("option %s=%s conflicts with the flag value true", name, value)
+		return
+	}
+	*dst = b
+}
+
+// done returns the first error, or an error for the options that were not read.
+func (q *remoteQuery) done() error {
+	for name := range q.values {
+		q.fail("unknown option %s", name)
+	}
+	return q.err
+}
+
+// requireHost fails if the URL has no host, such as the bucket name.
+func requireHost(u *url.URL, what string) error {
+	if u.Host == "" {
+		return fmt.Errorf("%w: %s: missing %s", errInvalidRemote, u.Redacted(), what)
+	}
+	return nil
+}
+
+func newAmazonS3Remote(ctx context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "bucket"); err != nil {
+		return nil, err
+	}
+	s3Opts := opts.S3
+	q := newRemoteQuery(u)
+	q.string("region", &s3Opts.Region)
+	q.string("endpoint", &s3Opts.Endpoint)
+	q.string("profile", &s3Opts.Profile)
+	q.bool("path-style", &s3Opts.UsePathStyle)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	s3Opts.Prefix = strings.Trim(u.Path, "/")
+
+	s3Client, err := remote.NewAmazonS3Client(ctx, s3Opts)
+	if err != nil {
+		return nil, fmt.Errorf("Amazon S3 configuration failed: %w", err)
+	}
+	return remote.NewAmazonS3(s3Client, u.Host, opts.CacheKey, s3Opts, opts.Verbose), nil
+}
+
+func newGoogleCloudStorageRemote(ctx context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "bucket"); err != nil {
+		return nil, err
+	}
+	gcsOpts := opts.GCS
+	q := newRemoteQuery(u)
+	q.string("endpoint", &gcsOpts.Endpoint)
+	q.string("credentials-file", &gcsOpts.CredentialsFile)
+	q.bool("anonymous", &gcsOpts.Anonymous)
+	q.bool("skip-bucket-check", &gcsOpts.SkipBucketCheck)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	gcsOpts.Prefix = strings.Trim(u.Path, "/")
+
+	cloudStorageClient, err := remote.NewGoogleCloudStorageClient(ctx, gcsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Google Cloud Storage configuration failed: %w", err)
+	}
+	return remote.NewGoogleCloudStorage(cloudStorageClient, u.Host, opts.CacheKey, gcsOpts, opts.Verbose), nil
+}
+
+func newAzureBlobRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "container"); err != nil {
+		return nil, err
+	}
+	azureOpts := opts.Azure
+	q := newRemoteQuery(u)
+	q.string("account-url", &azureOpts.AccountURL)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	azureOpts.Prefix = strings.Trim(u.Path, "/")
+
+	azureClient, err := remote.NewAzureBlobClient(azureOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Azure Blob Storage configuration failed: %w", err)
+	}
+	return remote.NewAzureBlob(azureClient, u.Host, opts.CacheKey, azureOpts, opts.Verbose), nil
+}
+
+// newHTTPRemote uses the URL without its query as the base URL, as the query
+// holds the options.
+func newHTTPRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "host"); err != nil {
+		return nil, err
+	}
+	httpOpts := opts.HTTP
+	q := newRemoteQuery(u)
+	q.bool("bazel-remote", &httpOpts.BazelRemote)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	base := *u
+	base.RawQuery = ""
+	base.Fragment = ""
+	return remote.NewHTTP(base.String(), httpOpts, opts.Verbose), nil
+}
+
+// newREAPIRemote takes the instance name from the path; the grpcs scheme enables TLS.
+func newREAPIRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "address"); err != nil {
+		return nil, err
+	}
+	reapiOpts := opts.REAPI
+	q := newRemoteQuery(u)
+	if instance := strings.Trim(u.Path, "/"); instance != "" {
+		if reapiOpts.InstanceName != "" && reapiOpts.InstanceName != instance {
+			q.fail("instance %s conflicts with the flag value %s", instance, reapiOpts.InstanceName)
+		}
+		reapiOpts.InstanceName = instance
+	}
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	if u.Scheme == "grpcs" {
+		reapiOpts.TLS = true
+	}
+
+	conn, err := remote.NewREAPIConn(u.Host, reapiOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Remote Execution API configuration failed: %w", err)
+	}
+	return remote.NewREAPI(conn, u.Host, opts.CacheKey, reapiOpts, opts.Verbose), nil
+}
+
+// newRedisRemote passes the URL, whose query holds the client options, to the Redis client.
+func newRedisRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	redisClient, err := remote.NewRedisClient(u.String(), opts.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("Redis configuration failed: %w", err)
+	}
+	return remote.NewRedis(redisClient, opts.CacheKey, opts.Redis, opts.Verbose), nil
+}
+
+func newSharedDirRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("%w: %s: file URLs of other hosts are not supported, mount the directory instead", errInvalidRemote, u)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("%w: %s: missing directory", errInvalidRemote, u)
+	}
+	if err := newRemoteQuery(u).done(); err != nil {
+		return nil, err
+	}
+	return remote.NewSharedDir(u.Path, opts.CacheKey, opts.Verbose), nil
+}
+
+// newOCIRemote takes the repository from the host and the path, as in oci://ghcr.io/org/gocache.
+func newOCIRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if err := requireHost(u, "registry"); err != nil {
+		return nil, err
+	}
+	ociOpts := opts.OCI
+	q := newRemoteQuery(u)
+	q.bool("insecure", &ociOpts.Insecure)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+
+	oci, err := remote.NewOCI(u.Host+u.Path, opts.CacheKey, ociOpts, opts.Verbose)
+	if err != nil {
+		return nil, fmt.Errorf("OCI registry configuration failed: %w", err)
+	}
+	return oci, nil
+}
+
+// newMemoryRemote takes the size limit from the max-bytes option, 256MiB by default.
+func newMemoryRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	q := newRemoteQuery(u)
+	var maxBytes string
+	q.string("max-bytes", &maxBytes)
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(cmp.Or(maxBytes, "268435456"), 10, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("%w: %s: max-bytes must be a positive number of bytes", errInvalidRemote, u)
+	}
+	return remote.NewMemory(n, opts.Verbose), nil
+}
+
+func newGitHubActionsRemote(_ context.Context, u *url.URL, opts Options) (remote.Storage, error) {
+	if u.Host != "" || u.Path != "" {
+		return nil, fmt.Errorf("%w: %s: the GitHub Actions cache takes no address, use gha://", errInvalidRemote, u)
+	}
+	if err := newRemoteQuery(u).done(); err != nil {
+		return nil, err
+	}
+	if opts.Actions.URL == "" && opts.Actions.ResultsURL == "" || opts.Actions.Token == "" {
+		return nil, fmt.Errorf("GitHub Actions cache configuration failed: ACTIONS_RESULTS_URL (or ACTIONS_CACHE_URL) and ACTIONS_RUNTIME_TOKEN must be set")
+	}
+	return remote.NewGitHubActions(opts.Actions, opts.CacheKey, opts.Verbose), nil
+}
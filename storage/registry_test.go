@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/reillywatson/gocache/storage/local"
+	"github.com/reillywatson/gocache/storage/remote"
+)
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// The query of an HTTP remote URL holds options, and is not part of the URLs
+// of the objects.
+func TestHTTPRemoteQuery(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	r, err := constructRemote(ctx, mustParseURL(t, srv.URL+"/cache?bazel-remote"), Options{})
+	if err != nil {
+		t.Fatalf("constructRemote: %v", err)
+	}
+	sum := sha256.Sum256([]byte("x"))
+	actionID, outputID := strings.Repeat("a", 64), hex.EncodeToString(sum[:])
+	if err := r.Put(ctx, actionID, outputID, 1, strings.NewReader("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	want := []string{"PUT /cache/cas/" + outputID, "PUT /cache/ac/" + actionID}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+
+	for _, rawURL := range []string{srv.URL + "/cache?token=secret", srv.URL + "/cache?bazel-remote=maybe"} {
+		if _, err := constructRemote(ctx, mustParseURL(t, rawURL), Options{}); !errors.Is(err, errInvalidRemote) {
+			t.Errorf("constructRemote(%s) error = %v, want %v", rawURL, err, errInvalidRemote)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("constructRemote(%s) error = %v, leaks the query", rawURL, err)
+		}
+	}
+}
+
+// --remote-mode caps the policies that the query of a tier URL sets.
+func TestTierRemoteMode(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		mode   local.RemoteMode
+		rawURL string
+		want   local.Tier
+		err    bool
+	}{
+		{local.ReadWrite, "mem://?write=back", local.Tier{Read: local.ReadThrough, Write: local.WriteBack, Fast: true}, false},
+		{local.ReadOnly, "mem://", local.Tier{Read: local.ReadThrough, Write: local.WriteSkip, Fast: true}, false},
+		{local.ReadOnly, "mem://?write=skip", local.Tier{Read: local.ReadThrough, Write: local.WriteSkip, Fast: true}, false},
+		{local.ReadOnly, "mem://?write=through", local.Tier{}, true},
+		{local.WriteOnly, "mem://?read=skip&write=back", local.Tier{Read: local.ReadSkip, Write: local.WriteBack, Fast: true}, false},
+		{local.WriteOnly, "mem://?read=through", local.Tier{}, true},
+	} {
+		tier, err := newTier(ctx, tt.rawURL, Options{Remote: local.MergeRemoteOptions{Mode: tt.mode}})
+		if tt.err {
+			if !errors.Is(err, errInvalidRemote) {
+				t.Errorf("newTier(%s) with %s error = %v, want %v", tt.rawURL, tt.mode, err, errInvalidRemote)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newTier(%s) with %s: %v", tt.rawURL, tt.mode, err)
+			continue
+		}
+		tier.Storage = nil
+		if tier != tt.want {
+			t.Errorf("newTier(%s) with %s = %+v, want %+v", tt.rawURL, tt.mode, tier, tt.want)
+		}
+	}
+}
+
+// The query of an S3 URL configures the endpoint of an S3-compatible service,
+// path-style addressing and the region requests are signed with.
+func TestAmazonS3RemoteQuery(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	var mu sync.Mutex
+	var requests, auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	rawURL := "s3://bucket/prefix?path-style&region=eu-west-1&endpoint=" + url.QueryEscape(srv.URL)
+	r, err := constructRemote(ctx, mustParseURL(t, rawURL), Options{CacheKey: "v1"})
+	if err != nil {
+		t.Fatalf("constructRemote: %v", err)
+	}
+	sum := sha256.Sum256([]byte("x"))
+	actionID := strings.Repeat("a", 64)
+	if err := r.Put(ctx, actionID, hex.EncodeToString(sum[:]), 1, strings.NewReader("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	want := "PUT /bucket/prefix/" + remote.BucketPath("v1") + "/" + actionID
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+	if len(auths) != 1 || !strings.Contains(auths[0], "/eu-west-1/s3/") {
+		t.Errorf("Authorization = %q, want a signature for eu-west-1", auths)
+	}
+
+	if _, err := constructRemote(ctx, mustParseURL(t, "s3://bucket?path-style=maybe"), Options{}); !errors.Is(err, errInvalidRemote) {
+		t.Errorf("constructRemote with an invalid path-style error = %v, want %v", err, errInvalidRemote)
+	}
+}
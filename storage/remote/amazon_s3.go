@@ -6,55 +6,112 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"path"
-	"runtime"
+	"time"
 
 	"github.com/reillywatson/gocache/storage/count"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
 )
 
-func NewAmazonS3Client(ctx context.Context) (*s3.Client, error) {
-	awsConfig, err := config.LoadDefaultConfig(ctx)
+// AmazonS3Options configures the Amazon S3 client and uploads.
+type AmazonS3Options struct {
+	// RetryMaxAttempts is the maximum number of attempts of a request, zero for the SDK default.
+	RetryMaxAttempts int
+	// RetryMaxBackoff is the maximum delay between two attempts, zero for the SDK default.
+	RetryMaxBackoff time.Duration
+	// MultipartThreshold is the size from which objects are uploaded in parts, zero to never use multipart uploads.
+	MultipartThreshold int64
+	// PartSize is the size of the parts of a multipart upload, zero for the SDK default.
+	PartSize int64
+	// Endpoint is the URL of an S3-compatible service such as MinIO, Cloudflare
+	// R2 or Ceph RGW, empty for Amazon S3.
+	Endpoint string
+	// UsePathStyle addresses buckets as <endpoint>/<bucket> instead of
+	// <bucket>.<endpoint>, as most self-hosted services require.
+	UsePathStyle bool
+	// Region overrides the region of the AWS config.
+	Region string
+	// Profile is the shared config profile to load credentials and settings from.
+	Profile string
+	// Prefix is prepended to the keys of the objects.
+	Prefix string
+}
+
+func NewAmazonS3Client(ctx context.Context, opts AmazonS3Options) (*s3.Client, error) {
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				if opts.RetryMaxAttempts > 0 {
+					o.MaxAttempts = opts.RetryMaxAttempts
+				}
+				if opts.RetryMaxBackoff > 0 {
+					o.MaxBackoff = opts.RetryMaxBackoff
+				}
+			})
+		}),
+	}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, loadOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	return s3.NewFromConfig(awsConfig), nil
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = opts.UsePathStyle
+		if opts.Endpoint == "" {
+			return
+		}
+		o.BaseEndpoint = aws.String(opts.Endpoint)
+		if o.Region == "" {
+			// Most S3-compatible services ignore the region, but requests must be signed with one.
+			o.Region = "us-east-1"
+		}
+		// Not all S3-compatible services support the checksums that the SDK
+		// sends by default.
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	}), nil
 }
 
-var _ Storage = &AmazonS3{}
+var (
+	_ Storage    = &AmazonS3{}
+	_ PutSkipper = &AmazonS3{}
+)
 
 // AmazonS3 is a remote cache that is backed by Amazon S3 bucket
 type AmazonS3 struct {
 	s3Client   *s3.Client
+	uploader   *manager.Uploader
 	bucket     string
 	bucketPath string
+	opts       AmazonS3Options
 	verbose    bool
 	count.Count
 }
 
-func NewAmazonS3(client *s3.Client, bucketName string, cacheKey string, verbose bool) *AmazonS3 {
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		goarch = runtime.GOARCH
-	}
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		goos = runtime.GOOS
-	}
-	goVersion := os.Getenv("GOVERSION")
-	if goVersion == "" {
-		goVersion = runtime.Version()
-	}
-	bucketPath := path.Join("cache", cacheKey, goarch, goos, goVersion)
+func NewAmazonS3(client *s3.Client, bucketName string, cacheKey string, opts AmazonS3Options, verbose bool) *AmazonS3 {
+	bucketPath := path.Join(opts.Prefix, BucketPath(cacheKey))
 	return &AmazonS3{
-		s3Client:   client,
+		s3Client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if opts.PartSize > 0 {
+				u.PartSize = opts.PartSize
+			}
+		}),
 		bucket:     bucketName,
 		bucketPath: bucketPath,
+		opts:       opts,
 		verbose:    verbose,
 	}
 }
@@ -69,12 +126,25 @@ func (a *AmazonS3) Kind() string {
 
 func (a *AmazonS3) Start(context.Context) error {
 	if a.verbose {
-		log.Printf("[%s] configured to s3://%s/%s", a.Kind(), a.bucket, a.bucketPath)
+		log.Printf("[%s] configured to s3://%s/%s at %s", a.Kind(), a.bucket, a.bucketPath, a.endpoint())
 	}
 	return nil
 }
 
-func (a *AmazonS3) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+// endpoint describes the endpoint that the client sends requests to.
+func (a *AmazonS3) endpoint() string {
+	o := a.s3Client.Options()
+	endpoint := fmt.Sprintf("https://s3.%s.amazonaws.com", o.Region)
+	if o.BaseEndpoint != nil {
+		endpoint = *o.BaseEndpoint
+	}
+	if o.UsePathStyle {
+		endpoint += " (path-style)"
+	}
+	return endpoint
+}
+
+func (a *AmazonS3) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
 	a.Count.Gets.Add(1)
 	actionKey := a.actionKey(actionID)
 	getObjectOutput, err := a.s3Client.GetObject(ctx, &s3.GetObjectInput{
@@ -83,42 +153,84 @@ func (a *AmazonS3) Get(ctx context.Context, actionID string) (string, int64, io.
 	})
 	if isNotFoundError(err) {
 		a.Count.Misses.Add(1)
-		return "", 0, nil, nil
+		return "", 0, time.Time{}, nil, nil
 	}
 	if err != nil {
 		a.Count.GetErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("[%s] get %s/%s (%v)", a.Kind(), a.bucket, actionKey, err)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (%v)", a.Kind(), a.bucket, actionKey, err)
 	}
 	contentSize := getObjectOutput.ContentLength
 	outputID, ok := getObjectOutput.Metadata[outputIDMetadataKey]
 	if !ok || outputID == "" {
 		a.Count.GetErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("[%s] get %s/%s (outputID not found in S3 metadata for object)", a.Kind(), a.bucket, actionKey)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (outputID not found in S3 metadata for object)", a.Kind(), a.bucket, actionKey)
 	}
-	return outputID, *contentSize, getObjectOutput.Body, nil
+	var putTime time.Time
+	if getObjectOutput.LastModified != nil {
+		putTime = *getObjectOutput.LastModified
+	}
+	return outputID, *contentSize, putTime, getObjectOutput.Body, nil
 }
 
+// Put uploads the object. The SDK can only retry a request, and compute its
+// checksum up front, if body is an io.ReadSeeker such as a file of the local
+// cache; other bodies are sent in a single attempt.
 func (a *AmazonS3) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
 	a.Count.Puts.Add(1)
 	actionKey := a.actionKey(actionID)
-	if _, err := a.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:        &a.bucket,
-		Key:           &actionKey,
-		Body:          body,
-		ContentLength: &size,
-		Metadata: map[string]string{
-			outputIDMetadataKey: outputID,
-		},
-	}, func(options *s3.Options) {
-		options.RetryMaxAttempts = 1 // We cannot perform seek in Body
-	}); err != nil {
+	metadata := map[string]string{
+		outputIDMetadataKey: outputID,
+	}
+	_, seekable := body.(io.ReadSeeker)
+
+	var err error
+	if seekable && a.opts.MultipartThreshold > 0 && size >= a.opts.MultipartThreshold {
+		_, err = a.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:   &a.bucket,
+			Key:      &actionKey,
+			Body:     body,
+			Metadata: metadata,
+		})
+	} else {
+		_, err = a.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        &a.bucket,
+			Key:           &actionKey,
+			Body:          body,
+			ContentLength: &size,
+			Metadata:      metadata,
+		}, func(options *s3.Options) {
+			if !seekable {
+				options.RetryMaxAttempts = 1 // We cannot perform seek in Body
+			}
+		})
+	}
+	if err != nil {
 		a.Count.PutErrors.Add(1)
-		return fmt.Errorf("[%s] put failed for %s/%s (failed to put object to S3 outputID: %s, size: %d)", a.Kind(), a.bucket, actionKey, outputID, size)
+		return fmt.Errorf("[%s] put failed for %s/%s (failed to put object to S3 outputID: %s, size: %d): %w", a.Kind(), a.bucket, actionKey, outputID, size, err)
 	}
 
 	return nil
 }
 
+func (a *AmazonS3) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	actionKey := a.actionKey(actionID)
+	headObjectOutput, err := a.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &a.bucket,
+		Key:    &actionKey,
+	})
+	if isNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[%s] head %s/%s (%v)", a.Kind(), a.bucket, actionKey, err)
+	}
+	if headObjectOutput.Metadata[outputIDMetadataKey] != outputID || headObjectOutput.ContentLength == nil || *headObjectOutput.ContentLength != size {
+		return false, nil
+	}
+	a.Count.SkippedPuts.Add(1)
+	return true, nil
+}
+
 func (a *AmazonS3) Close() error {
 	return nil
 }
@@ -132,7 +244,8 @@ func isNotFoundError(err error) bool {
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
 			code := ae.ErrorCode()
-			return code == "AccessDenied" || code == "NoSuchKey"
+			// HeadObject reports a missing key as NotFound.
+			return code == "AccessDenied" || code == "NoSuchKey" || code == "NotFound"
 		}
 	}
 	return false
@@ -0,0 +1,160 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3-compatible service addressed in path style, which keeps
+// the objects in memory and fails the next failPuts PUT requests.
+type fakeS3 struct {
+	*httptest.Server
+	failPuts atomic.Int64
+
+	mu       sync.Mutex
+	objects  map[string]fakeS3Object
+	requests []string
+}
+
+type fakeS3Object struct {
+	body     []byte
+	outputID string
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{objects: map[string]fakeS3Object{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.failPuts.Add(-1) >= 0 {
+			s3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		f.objects[r.URL.Path] = fakeS3Object{body: body, outputID: r.Header.Get("X-Amz-Meta-" + outputIDMetadataKey)}
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("X-Amz-Meta-"+outputIDMetadataKey, obj.outputID)
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(obj.body)
+		}
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// setAWSTestEnv sets static credentials, and hides the AWS configuration of
+// the machine running the tests.
+func setAWSTestEnv(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+}
+
+func newTestS3(t *testing.T, f *fakeS3) *AmazonS3 {
+	t.Helper()
+	setAWSTestEnv(t)
+	opts := AmazonS3Options{Endpoint: f.URL, UsePathStyle: true, RetryMaxBackoff: time.Millisecond}
+	client, err := NewAmazonS3Client(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAmazonS3(client, "bucket", "key", opts, false)
+}
+
+// A put from a file of the local cache is retried, since the SDK can seek
+// back to its start.
+func TestAmazonS3PutRetry(t *testing.T) {
+	f := newFakeS3(t)
+	s := newTestS3(t, f)
+	data := []byte("some object")
+	file := filepath.Join(t.TempDir(), "o")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	f.failPuts.Store(1)
+	actionID, outputID := actionIDOf("a"), actionIDOf(string(data))
+	if err := s.Put(context.Background(), actionID, outputID, int64(len(data)), body); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := len(f.requests); n != 2 {
+		t.Errorf("%d requests, want a failed attempt and a retry: %q", n, f.requests)
+	}
+	gotID, _, _, rc, err := s.Get(context.Background(), actionID)
+	if err != nil || gotID != outputID {
+		t.Fatalf("Get = %q, %v; want %q", gotID, err, outputID)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || string(got) != string(data) {
+		t.Errorf("Get body = %q, %v; want %q", got, err, data)
+	}
+}
+
+func TestAmazonS3ClientOptions(t *testing.T) {
+	setAWSTestEnv(t)
+	ctx := context.Background()
+	client, err := NewAmazonS3Client(ctx, AmazonS3Options{Endpoint: "http://minio:9000", UsePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := client.Options()
+	if o.BaseEndpoint == nil || *o.BaseEndpoint != "http://minio:9000" || !o.UsePathStyle {
+		t.Errorf("endpoint = %v, path style = %v; want http://minio:9000 in path style", o.BaseEndpoint, o.UsePathStyle)
+	}
+	// Requests to S3-compatible services must be signed with some region.
+	if o.Region != "us-east-1" {
+		t.Errorf("region = %q, want the us-east-1 default", o.Region)
+	}
+
+	client, err = NewAmazonS3Client(ctx, AmazonS3Options{Region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := client.Options(); o.BaseEndpoint != nil || o.UsePathStyle || o.Region != "eu-west-1" {
+		t.Errorf("endpoint = %v, path style = %v, region = %q; want Amazon S3 in eu-west-1", o.BaseEndpoint, o.UsePathStyle, o.Region)
+	}
+}
@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// AzureBlobOptions configures the Azure Blob Storage client. Credentials are
+// taken from the connection string if set, then from the SAS token, and
+// otherwise from the default Azure credential chain.
+type AzureBlobOptions struct {
+	// AccountURL is the blob service URL, e.g. https://<account>.blob.core.windows.net.
+	AccountURL string
+	// ConnectionString is a storage account connection string.
+	ConnectionString string
+	// SASToken is a shared access signature for the account or the container.
+	SASToken string
+	// Prefix is prepended to the names of the blobs.
+	Prefix string
+}
+
+func NewAzureBlobClient(opts AzureBlobOptions) (*azblob.Client, error) {
+	var client *azblob.Client
+	var err error
+	switch {
+	case opts.ConnectionString != "":
+		client, err = azblob.NewClientFromConnectionString(opts.ConnectionString, nil)
+	case opts.AccountURL == "":
+		return nil, fmt.Errorf("an account URL or a connection string is required")
+	case opts.SASToken != "":
+		client, err = azblob.NewClientWithNoCredential(opts.AccountURL+"?"+strings.TrimPrefix(opts.SASToken, "?"), nil)
+	default:
+		cred, credErr := azidentity.NewDefaultAzureCredential(nil)
+		if credErr != nil {
+			return nil, fmt.Errorf("failed to load Azure credentials: %w", credErr)
+		}
+		client, err = azblob.NewClient(opts.AccountURL, cred, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob Storage client: %w", err)
+	}
+	return client, nil
+}
+
+var (
+	_ Storage    = &AzureBlob{}
+	_ PutSkipper = &AzureBlob{}
+)
+
+// AzureBlob is a remote cache that is backed by an Azure Blob Storage container.
+type AzureBlob struct {
+	client     *azblob.Client
+	container  string
+	bucketPath string
+	verbose    bool
+	count.Count
+}
+
+// NewAzureBlob creates a new AzureBlob instance.
+func NewAzureBlob(client *azblob.Client, container string, cacheKey string, opts AzureBlobOptions, verbose bool) *AzureBlob {
+	bucketPath := path.Join(opts.Prefix, BucketPath(cacheKey))
+
+	return &AzureBlob{
+		client:     client,
+		container:  container,
+		bucketPath: bucketPath,
+		verbose:    verbose,
+	}
+}
+
+func (a *AzureBlob) blobName(actionID string) string {
+	return fmt.Sprintf("%s/%s", a.bucketPath, actionID)
+}
+
+// containerFullPath is the URL of the bucket path, for logs and errors. The
+// query is removed, as it may hold a SAS token.
+func (a *AzureBlob) containerFullPath() string {
+	u, err := url.Parse(a.client.URL())
+	if err != nil {
+		return path.Join(a.container, a.bucketPath)
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.JoinPath(a.container, a.bucketPath).String()
+}
+
+func (a *AzureBlob) Kind() string {
+	return "azure"
+}
+
+func (a *AzureBlob) Start(ctx context.Context) error {
+	if a.verbose {
+		log.Printf("[%s] start to %s", a.Kind(), a.containerFullPath())
+	}
+	if _, err := a.client.ServiceClient().NewContainerClient(a.container).GetProperties(ctx, nil); err != nil {
+		return fmt.Errorf("[%s] failed to start %s: %w", a.Kind(), a.containerFullPath(), err)
+	}
+	return nil
+}
+
+func (a *AzureBlob) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	a.Count.Gets.Add(1)
+	blobName := a.blobName(actionID)
+	resp, err := a.client.DownloadStream(ctx, a.container, blobName, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		a.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		a.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (%v)", a.Kind(), a.container, blobName, err)
+	}
+
+	outputID := metadataOutputID(resp.Metadata)
+	if outputID == "" || resp.ContentLength == nil {
+		_ = resp.Body.Close()
+		a.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (outputID not found in blob metadata)", a.Kind(), a.container, blobName)
+	}
+	var putTime time.Time
+	if resp.LastModified != nil {
+		putTime = *resp.LastModified
+	}
+	return outputID, *resp.ContentLength, putTime, resp.Body, nil
+}
+
+func (a *AzureBlob) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	a.Count.Puts.Add(1)
+	blobName := a.blobName(actionID)
+	metadata := map[string]*string{
+		outputIDMetadataKey: &outputID,
+	}
+
+	var err error
+	if f, ok := body.(*os.File); ok {
+		_, err = a.client.UploadFile(ctx, a.container, blobName, f, &azblob.UploadFileOptions{Metadata: metadata})
+	} else {
+		_, err = a.client.UploadStream(ctx, a.container, blobName, body, &azblob.UploadStreamOptions{Metadata: metadata})
+	}
+	if err != nil {
+		a.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s/%s (outputID: %s, size: %d): %w", a.Kind(), a.container, blobName, outputID, size, err)
+	}
+
+	if a.verbose {
+		log.Printf("[%s] put success for %s/%s (outputID: %s, size: %d)", a.Kind(), a.container, blobName, outputID, size)
+	}
+	return nil
+}
+
+func (a *AzureBlob) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	blobName := a.blobName(actionID)
+	props, err := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(blobName).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[%s] get properties %s/%s (%v)", a.Kind(), a.container, blobName, err)
+	}
+	if metadataOutputID(props.Metadata) != outputID || props.ContentLength == nil || *props.ContentLength != size {
+		return false, nil
+	}
+	a.Count.SkippedPuts.Add(1)
+	return true, nil
+}
+
+// metadataOutputID returns the OutputID stored in the metadata of a blob.
+func metadataOutputID(metadata map[string]*string) string {
+	for k, v := range metadata {
+		// The service may change the case of metadata names.
+		if strings.EqualFold(k, outputIDMetadataKey) && v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+func (a *AzureBlob) Close() error {
+	return nil
+}
+
+func (a *AzureBlob) Summary() string {
+	return a.Count.Summary(a.Kind())
+}
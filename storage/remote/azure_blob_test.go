@@ -0,0 +1,291 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzureBlobServer implements the subset of the Blob service REST API that
+// AzureBlob uses, for the containers of a single path-style account.
+type fakeAzureBlobServer struct {
+	*httptest.Server
+	containers map[string]bool
+
+	mu     sync.Mutex
+	blobs  map[string]fakeAzureBlob // by <container>/<blob>
+	blocks map[string][]byte        // staged blocks by <container>/<blob>\x00<blockID>
+	sigs   []string                 // sig query parameters of the requests
+}
+
+type fakeAzureBlob struct {
+	data         []byte
+	outputID     string
+	lastModified time.Time
+}
+
+const fakeAzureAccount = "/devstoreaccount1/"
+
+func newFakeAzureBlob(t *testing.T, containers ...string) *fakeAzureBlobServer {
+	t.Helper()
+	f := &fakeAzureBlobServer{
+		containers: map[string]bool{},
+		blobs:      map[string]fakeAzureBlob{},
+		blocks:     map[string][]byte{},
+	}
+	for _, c := range containers {
+		f.containers[c] = true
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func azureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+func (f *fakeAzureBlobServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sigs = append(f.sigs, r.URL.Query().Get("sig"))
+	name, ok := strings.CutPrefix(r.URL.Path, fakeAzureAccount)
+	if !ok {
+		azureError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	container, blob, _ := strings.Cut(name, "/")
+	if !f.containers[container] {
+		azureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("restype") == "container" {
+		w.Header().Set("ETag", `"container"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, _ := io.ReadAll(r.Body)
+		f.blocks[name+"\x00"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Blocks []string `xml:",any"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			azureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.Blocks {
+			block, ok := f.blocks[name+"\x00"+id]
+			if !ok {
+				azureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		f.putBlob(w, r, name, data)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.putBlob(w, r, name, data)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.blobs[name]
+		if !ok || blob == "" {
+			azureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("x-ms-meta-outputid", b.outputID)
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.Header().Set("ETag", `"`+strconv.FormatInt(b.lastModified.UnixNano(), 10)+`"`)
+		w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(b.data)
+		}
+	default:
+		azureError(w, http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+// putBlob stores a blob with the metadata of the request. f.mu must be held.
+func (f *fakeAzureBlobServer) putBlob(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	now := time.Now().UTC().Truncate(time.Second)
+	f.blobs[name] = fakeAzureBlob{data: data, outputID: r.Header.Get("x-ms-meta-outputid"), lastModified: now}
+	w.Header().Set("ETag", `"`+strconv.FormatInt(now.UnixNano(), 10)+`"`)
+	w.Header().Set("Last-Modified", now.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newTestAzureBlob(t *testing.T, f *fakeAzureBlobServer, container string) *AzureBlob {
+	t.Helper()
+	client, err := NewAzureBlobClient(AzureBlobOptions{AccountURL: f.URL + fakeAzureAccount, SASToken: "?sv=2024-01-01&sig=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAzureBlob(client, container, "v1", AzureBlobOptions{Prefix: "prefix"}, false)
+}
+
+func TestAzureBlobPutGet(t *testing.T) {
+	f := newFakeAzureBlob(t, "gocache")
+	a := newTestAzureBlob(t, f, "gocache")
+	ctx := context.Background()
+	if err := a.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for _, data := range [][]byte{[]byte("hello, world"), nil} {
+		actionID := actionIDOf(string(data))
+		sum := sha256.Sum256(data)
+		outputID := hex.EncodeToString(sum[:])
+		if err := a.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, ok := f.blobs["gocache/"+a.blobName(actionID)]; !ok {
+			t.Errorf("no blob at %s", a.blobName(actionID))
+		}
+		gotOutputID, size, putTime, body, err := a.Get(ctx, actionID)
+		if err != nil || body == nil {
+			t.Fatalf("Get = %v, %v; want a hit", body, err)
+		}
+		got, _ := io.ReadAll(body)
+		_ = body.Close()
+		if gotOutputID != outputID || size != int64(len(data)) || !bytes.Equal(got, data) {
+			t.Errorf("Get = %s, %d, %q; want %s, %d, %q", gotOutputID, size, got, outputID, len(data), data)
+		}
+		if putTime.IsZero() {
+			t.Errorf("Get: no put time")
+		}
+		if skip, err := a.SkipPut(ctx, actionID, outputID, int64(len(data))); err != nil || !skip {
+			t.Errorf("SkipPut = %v, %v; want true", skip, err)
+		}
+	}
+	for _, sig := range f.sigs {
+		if sig != "secret" {
+			t.Errorf("request without the SAS token")
+		}
+	}
+}
+
+func TestAzureBlobMiss(t *testing.T) {
+	f := newFakeAzureBlob(t, "gocache")
+	a := newTestAzureBlob(t, f, "gocache")
+	ctx := context.Background()
+	outputID, _, _, body, err := a.Get(ctx, actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if a.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", a.Count.Misses.Load())
+	}
+	if skip, err := a.SkipPut(ctx, actionIDOf("missing"), actionIDOf("o"), 1); err != nil || skip {
+		t.Errorf("SkipPut = %v, %v; want false", skip, err)
+	}
+}
+
+// The container URL in logs and errors has a well-formed path and no SAS token.
+func TestAzureBlobStartError(t *testing.T) {
+	f := newFakeAzureBlob(t)
+	a := newTestAzureBlob(t, f, "missing")
+	err := a.Start(context.Background())
+	if err == nil {
+		t.Fatal("Start succeeded without the container")
+	}
+	want := f.URL + fakeAzureAccount + "missing/prefix/" + BucketPath("v1")
+	if got := a.containerFullPath(); got != want {
+		t.Errorf("containerFullPath = %s, want %s", got, want)
+	}
+	if !strings.Contains(err.Error(), want) || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Start error = %v, want %s without the SAS token", err, want)
+	}
+}
+
+// A client URL without a trailing slash still gives a well-formed path.
+func TestAzureBlobContainerFullPath(t *testing.T) {
+	client, err := NewAzureBlobClient(AzureBlobOptions{AccountURL: "https://account.blob.core.windows.net", SASToken: "sig=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAzureBlob(client, "gocache", "v1", AzureBlobOptions{}, false)
+	want := "https://account.blob.core.windows.net/gocache/" + BucketPath("v1")
+	if got := a.containerFullPath(); got != want {
+		t.Errorf("containerFullPath = %s, want %s", got, want)
+	}
+}
+
+// Large streamed bodies are uploaded as staged blocks.
+func TestAzureBlobBlockList(t *testing.T) {
+	f := newFakeAzureBlob(t, "gocache")
+	a := newTestAzureBlob(t, f, "gocache")
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), (3<<20)/16)
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := a.Put(ctx, actionIDOf("large"), outputID, int64(len(data)), bytesReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if len(f.blocks) < 2 {
+		t.Errorf("%d blocks staged, want several", len(f.blocks))
+	}
+	for id := range f.blocks {
+		if _, err := base64.StdEncoding.DecodeString(id[strings.IndexByte(id, 0)+1:]); err != nil {
+			t.Errorf("block ID is not base64: %s", id)
+		}
+	}
+	_, size, _, body, err := a.Get(ctx, actionIDOf("large"))
+	if err != nil || body == nil {
+		t.Fatalf("Get = %v, %v; want a hit", body, err)
+	}
+	got, _ := io.ReadAll(body)
+	_ = body.Close()
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Errorf("Get = %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestAzureBlobStorage(t *testing.T) {
+	f := newFakeAzureBlob(t, "gocache")
+	a := newTestAzureBlob(t, f, "gocache")
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	testStorage(t, a)
+}
+
+// Only a missing blob is a miss: a blob without an OutputID or a missing
+// container is an error.
+func TestAzureBlobGetError(t *testing.T) {
+	f := newFakeAzureBlob(t, "gocache")
+	a := newTestAzureBlob(t, f, "gocache")
+	ctx := context.Background()
+	f.blobs["gocache/"+a.blobName(actionIDOf("foreign"))] = fakeAzureBlob{data: []byte("data"), lastModified: time.Now()}
+	if outputID, _, _, body, err := a.Get(ctx, actionIDOf("foreign")); err == nil || body != nil {
+		t.Errorf("Get of a blob without an OutputID = %q, %v, %v; want an error", outputID, body, err)
+	}
+
+	other := newTestAzureBlob(t, f, "missing")
+	if outputID, _, _, body, err := other.Get(ctx, actionIDOf("a")); err == nil || body != nil {
+		t.Errorf("Get from a missing container = %q, %v, %v; want an error", outputID, body, err)
+	}
+	if a.Count.GetErrors.Load() != 1 || other.Count.GetErrors.Load() != 1 {
+		t.Errorf("GetErrors = %d, %d; want 1, 1", a.Count.GetErrors.Load(), other.Count.GetErrors.Load())
+	}
+}
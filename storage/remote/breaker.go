@@ -0,0 +1,257 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BreakerOptions configures the deadlines and the circuit breaker of a remote cache.
+type BreakerOptions struct {
+	// GetTimeout and PutTimeout are the deadlines of a get, including the
+	// download of the body, and of a put. Zero means no deadline.
+	GetTimeout time.Duration
+	PutTimeout time.Duration
+	// SlowThreshold is the duration above which a successful call counts as
+	// a failure for the breaker. Zero disables it.
+	SlowThreshold time.Duration
+	// Failures is the number of consecutive failures or slow calls that open
+	// the breaker. Zero disables the breaker.
+	Failures int
+	// Cooldown is how long the breaker stays open before a single call probes
+	// the storage again. Zero keeps it open for the rest of the run.
+	Cooldown time.Duration
+}
+
+// Enabled reports whether any deadline or the breaker is set.
+func (o BreakerOptions) Enabled() bool {
+	return o.GetTimeout > 0 || o.PutTimeout > 0 || o.Failures > 0
+}
+
+// ErrBreakerOpen is returned by the puts that a Breaker skips while it is open.
+var ErrBreakerOpen = errors.New("breaker open")
+
+var (
+	_ Storage    = &Breaker{}
+	_ PutSkipper = &Breaker{}
+)
+
+// Breaker is a remote cache that bounds the calls to another one with
+// deadlines, and stops calling it after repeated failures. While the breaker
+// is open, gets miss and puts are skipped, so only the local cache is used.
+type Breaker struct {
+	Storage
+	opts    BreakerOptions
+	verbose bool
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time // zero if open for the rest of the run
+	probing   bool      // whether a call is probing the storage after the cooldown
+
+	timeouts atomic.Int64
+	trips    atomic.Int64
+	skipped  atomic.Int64
+}
+
+// NewBreaker creates a new Breaker instance around storage.
+func NewBreaker(storage Storage, opts BreakerOptions, verbose bool) *Breaker {
+	return &Breaker{
+		Storage: storage,
+		opts:    opts,
+		verbose: verbose,
+	}
+}
+
+// call is a call that the breaker let through.
+type call struct {
+	start time.Time
+	probe bool
+}
+
+// allow reports whether a call may be made. Once the cooldown has passed, a
+// single call is let through to probe the storage; the breaker closes after it
+// succeeds, and stays open for another cooldown after it fails.
+func (b *Breaker) allow() (call, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := call{start: time.Now()}
+	if !b.open {
+		return c, true
+	}
+	if !b.probing && !b.openUntil.IsZero() && c.start.After(b.openUntil) {
+		b.probing = true
+		c.probe = true
+		return c, true
+	}
+	b.skipped.Add(1)
+	return c, false
+}
+
+// done records the outcome of a call.
+func (b *Breaker) done(c call, err error) {
+	if b.opts.Failures <= 0 {
+		return
+	}
+	elapsed := time.Since(c.start)
+	slow := b.opts.SlowThreshold > 0 && elapsed > b.opts.SlowThreshold
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.probe {
+		b.probing = false
+	}
+	if err == nil && !slow {
+		b.failures = 0
+		if c.probe {
+			b.open = false
+			if b.verbose {
+				log.Printf("[%s] breaker closed after a successful probe", b.Kind())
+			}
+		}
+		return
+	}
+	b.failures++
+	// The calls that were let through before the breaker opened do not
+	// extend the cooldown; a failed probe does.
+	if !c.probe && (b.open || b.failures < b.opts.Failures) {
+		return
+	}
+	b.open = true
+	b.trips.Add(1)
+	reason := fmt.Sprintf("error: %v", err)
+	if err == nil {
+		reason = fmt.Sprintf("slow call: %v", elapsed.Round(time.Millisecond))
+	}
+	if b.opts.Cooldown > 0 {
+		b.openUntil = time.Now().Add(b.opts.Cooldown)
+		log.Printf("Warning: [%s] breaker opened for %v after %d consecutive failures, last %s", b.Kind(), b.opts.Cooldown, b.failures, reason)
+	} else {
+		log.Printf("Warning: [%s] breaker opened for the rest of the run after %d consecutive failures, last %s", b.Kind(), b.failures, reason)
+	}
+}
+
+// countTimeout counts the calls that failed because of their deadline.
+func (b *Breaker) countTimeout(ctx context.Context, err error) {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		b.timeouts.Add(1)
+	}
+}
+
+func (b *Breaker) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	c, ok := b.allow()
+	if !ok {
+		return "", 0, time.Time{}, nil, nil
+	}
+	cancel := context.CancelFunc(func() {})
+	if b.opts.GetTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.opts.GetTimeout)
+	}
+	outputID, size, putTime, body, err := b.Storage.Get(ctx, actionID)
+	if err != nil || outputID == "" {
+		b.countTimeout(ctx, err)
+		b.done(c, err)
+		cancel()
+		return outputID, size, putTime, body, err
+	}
+	// The body is read after Get returns, under the same deadline, and the
+	// outcome of the call is only known once it is read.
+	return outputID, size, putTime, &cancelReadCloser{
+		ReadCloser: body,
+		ctx:        ctx,
+		cancel:     cancel,
+		finish: func(err error) {
+			b.countTimeout(ctx, err)
+			b.done(c, err)
+		},
+	}, nil
+}
+
+func (b *Breaker) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	c, ok := b.allow()
+	if !ok {
+		return ErrBreakerOpen
+	}
+	if b.opts.PutTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.PutTimeout)
+		defer cancel()
+	}
+	err := b.Storage.Put(ctx, actionID, outputID, size, body)
+	b.countTimeout(ctx, err)
+	b.done(c, err)
+	return err
+}
+
+// SkipPut looks the object up in the wrapped storage, if it is a PutSkipper,
+// under the put deadline. While the breaker is open, it returns ErrBreakerOpen.
+func (b *Breaker) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	s, ok := b.Storage.(PutSkipper)
+	if !ok {
+		return false, nil
+	}
+	c, ok := b.allow()
+	if !ok {
+		return false, ErrBreakerOpen
+	}
+	if b.opts.PutTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.PutTimeout)
+		defer cancel()
+	}
+	skip, err := s.SkipPut(ctx, actionID, outputID, size)
+	b.countTimeout(ctx, err)
+	b.done(c, err)
+	return skip, err
+}
+
+func (b *Breaker) Summary() string {
+	summary := b.Storage.Summary()
+	if b.opts.GetTimeout > 0 || b.opts.PutTimeout > 0 {
+		summary += fmt.Sprintf("\n[%s] %d timeouts", b.Kind(), b.timeouts.Load())
+	}
+	if b.opts.Failures > 0 {
+		summary += fmt.Sprintf("\n[%s] breaker: %d trips, %d calls skipped", b.Kind(), b.trips.Load(), b.skipped.Load())
+	}
+	return summary
+}
+
+// cancelReadCloser is the body of a get. The outcome of the get is recorded
+// once the body is read to the end, fails to read, or is closed before the
+// end, which only fails the get if its deadline has passed. Closing the body
+// cancels its context.
+type cancelReadCloser struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	finish func(err error)
+	once   sync.Once
+}
+
+func (c *cancelReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.once.Do(func() { c.finish(nil) })
+	} else if err != nil {
+		c.once.Do(func() { c.finish(err) })
+	}
+	return n, err
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() {
+		if errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+			c.finish(c.ctx.Err())
+		} else {
+			c.finish(nil)
+		}
+	})
+	c.cancel()
+	return err
+}
@@ -0,0 +1,172 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getStorage is a storage whose gets are served by a function.
+type getStorage struct {
+	*Memory
+	gets atomic.Int64
+	get  func(ctx context.Context) (io.ReadCloser, error)
+}
+
+func newGetStorage(get func(ctx context.Context) (io.ReadCloser, error)) *getStorage {
+	return &getStorage{Memory: NewMemory(0, false), get: get}
+}
+
+func (s *getStorage) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	s.gets.Add(1)
+	body, err := s.get(ctx)
+	if err != nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	return actionID, 1, time.Now(), body, nil
+}
+
+// readerFunc is a body whose reads are served by a function.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// getBody gets an action from the breaker and reads its body to the end.
+func getBody(b *Breaker) error {
+	_, _, _, body, err := b.Get(context.Background(), "a")
+	if err != nil || body == nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.ReadAll(body)
+	return err
+}
+
+// A get fails once its body fails to read, or is read too slowly or past its
+// deadline, since the body is read after Get returns.
+func TestBreakerGetBody(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		opts     BreakerOptions
+		read     func(ctx context.Context) readerFunc
+		timeouts int64
+	}{
+		{
+			name: "error",
+			opts: BreakerOptions{Failures: 1},
+			read: func(context.Context) readerFunc {
+				return func([]byte) (int, error) { return 0, errors.New("connection reset") }
+			},
+		},
+		{
+			name: "slow",
+			opts: BreakerOptions{Failures: 1, SlowThreshold: 10 * time.Millisecond},
+			read: func(context.Context) readerFunc {
+				return func([]byte) (int, error) {
+					time.Sleep(20 * time.Millisecond)
+					return 0, io.EOF
+				}
+			},
+		},
+		{
+			name: "timeout",
+			opts: BreakerOptions{Failures: 1, GetTimeout: 10 * time.Millisecond},
+			read: func(ctx context.Context) readerFunc {
+				return func([]byte) (int, error) {
+					<-ctx.Done()
+					return 0, ctx.Err()
+				}
+			},
+			timeouts: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newGetStorage(func(ctx context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(tt.read(ctx)), nil
+			})
+			b := NewBreaker(s, tt.opts, false)
+			_ = getBody(b)
+			if b.trips.Load() != 1 {
+				t.Errorf("trips = %d, want 1", b.trips.Load())
+			}
+			if b.timeouts.Load() != tt.timeouts {
+				t.Errorf("timeouts = %d, want %d", b.timeouts.Load(), tt.timeouts)
+			}
+			_ = getBody(b)
+			if s.gets.Load() != 1 {
+				t.Errorf("gets = %d, want 1 since the breaker is open", s.gets.Load())
+			}
+		})
+	}
+}
+
+// A body that is read to the end, or closed early, does not fail the get.
+func TestBreakerGetBodyClosed(t *testing.T) {
+	s := newGetStorage(func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("x")), nil
+	})
+	b := NewBreaker(s, BreakerOptions{Failures: 1}, false)
+	if err := getBody(b); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, body, _ := b.Get(context.Background(), "a")
+	_ = body.Close()
+	if b.trips.Load() != 0 {
+		t.Errorf("trips = %d, want 0", b.trips.Load())
+	}
+}
+
+// After the cooldown, a single call probes the storage while the others are
+// skipped.
+func TestBreakerProbe(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	probing, release := make(chan struct{}), make(chan struct{})
+	s := newGetStorage(func(context.Context) (io.ReadCloser, error) {
+		if fail.Load() {
+			return nil, errors.New("unavailable")
+		}
+		probing <- struct{}{}
+		<-release
+		return io.NopCloser(strings.NewReader("x")), nil
+	})
+	b := NewBreaker(s, BreakerOptions{Failures: 1, Cooldown: 10 * time.Millisecond}, false)
+
+	_ = getBody(b)
+	time.Sleep(20 * time.Millisecond)
+	_ = getBody(b) // the failed probe keeps the breaker open for another cooldown
+	if b.trips.Load() != 2 || s.gets.Load() != 2 {
+		t.Fatalf("trips = %d, gets = %d; want 2, 2", b.trips.Load(), s.gets.Load())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	fail.Store(false)
+	probed := make(chan error)
+	go func() { probed <- getBody(b) }()
+	<-probing
+	for range 3 {
+		_ = getBody(b)
+	}
+	if s.gets.Load() != 3 {
+		t.Errorf("gets = %d while probing, want 3", s.gets.Load())
+	}
+	close(release)
+	if err := <-probed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The successful probe closed the breaker.
+	go func() { <-probing }()
+	if err := getBody(b); err != nil {
+		t.Fatal(err)
+	}
+	if s.gets.Load() != 4 {
+		t.Errorf("gets = %d after the probe, want 4", s.gets.Load())
+	}
+}
@@ -0,0 +1,467 @@
+package remote
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+)
+
+const (
+	// githubActionsAPIVersion is the version of the cache API in the Accept header.
+	githubActionsAPIVersion = "application/json;api-version=6.0-preview.1"
+	// githubActionsChunkSize is the size of the chunks of an upload.
+	githubActionsChunkSize = 32 << 20
+	// githubActionsTwirpService is the path of the twirp service of the cache
+	// service v2 under the results URL.
+	githubActionsTwirpService = "twirp/github.actions.results.api.v1.CacheService/"
+)
+
+// GitHubActionsOptions configures a GitHub Actions cache remote. Inside a
+// workflow, the URLs and the token come from ACTIONS_CACHE_URL,
+// ACTIONS_RESULTS_URL and ACTIONS_RUNTIME_TOKEN, which are exposed to steps
+// by actions such as crazy-max/ghaction-github-runtime.
+type GitHubActionsOptions struct {
+	// URL is the base URL of the legacy cache service, which is still the
+	// one of GitHub Enterprise Server.
+	URL string
+	// ResultsURL is the base URL of the cache service v2, used instead of
+	// URL if set.
+	ResultsURL string
+	// Token is the runtime token of the workflow run.
+	Token string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+var _ Storage = &GitHubActions{}
+
+// GitHubActions is a remote cache that is backed by the GitHub Actions cache
+// service: either the cache service v2 of github.com, a twirp API whose
+// entries are uploaded to and downloaded from signed Azure Blob Storage URLs,
+// or the legacy _apis/artifactcache API of GitHub Enterprise Server.
+//
+// Cache entries are immutable and a key can only be reserved by one job, so
+// the key of an object is gocache/<actionID>/<outputID>: an entry is never
+// overwritten with a different output, and a job that loses the reservation
+// race for a key can leave the upload to the winner. Gets look up the
+// gocache/<actionID>/ prefix, for which the service returns the newest entry.
+// The bucket path is the version of the entries, which keeps caches of
+// different toolchains apart.
+type GitHubActions struct {
+	baseURL  string // of the legacy API, empty with v2
+	twirpURL string // of the v2 API, empty with the legacy one
+	opts     GitHubActionsOptions
+	version  string
+	verbose  bool
+	reserved atomic.Int64
+	count.Count
+}
+
+// NewGitHubActions creates a new GitHubActions instance.
+func NewGitHubActions(opts GitHubActionsOptions, cacheKey string, verbose bool) *GitHubActions {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	bucketPath := BucketPath(cacheKey)
+	version := sha256.Sum256([]byte(bucketPath))
+
+	g := &GitHubActions{
+		opts:    opts,
+		version: hex.EncodeToString(version[:]),
+		verbose: verbose,
+	}
+	if opts.ResultsURL != "" {
+		g.twirpURL = strings.TrimSuffix(opts.ResultsURL, "/") + "/" + githubActionsTwirpService
+	} else {
+		g.baseURL = strings.TrimSuffix(opts.URL, "/") + "/_apis/artifactcache"
+	}
+	return g
+}
+
+func githubActionsKeyPrefix(actionID string) string {
+	return fmt.Sprintf("gocache/%s/", actionID)
+}
+
+func (g *GitHubActions) Kind() string {
+	return "github-actions"
+}
+
+func (g *GitHubActions) Start(context.Context) error {
+	if g.verbose {
+		log.Printf("[%s] configured to %s (version %s)", g.Kind(), cmp.Or(g.twirpURL, g.baseURL), g.version)
+	}
+	return nil
+}
+
+// do sends an API request, with a JSON body if in is not nil.
+func (g *GitHubActions) do(ctx context.Context, method, url string, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return g.send(req)
+}
+
+func (g *GitHubActions) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept", githubActionsAPIVersion)
+	req.Header.Set("Authorization", "Bearer "+g.opts.Token)
+	return g.opts.Client.Do(req)
+}
+
+// twirp calls a method of the cache service v2 and decodes its response into
+// out. It returns the status of an unexpected response along with its error.
+func (g *GitHubActions) twirp(ctx context.Context, method string, in, out any) (int, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.twirpURL+method, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+g.opts.Token)
+	resp, err := g.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, githubActionsError(resp)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// githubActionsError reads the error of an unexpected response.
+func githubActionsError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = resp.Body.Close()
+	if len(msg) == 0 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+type githubActionsEntry struct {
+	CacheKey        string    `json:"cacheKey"`
+	CreationTime    time.Time `json:"creationTime"`
+	ArchiveLocation string    `json:"archiveLocation"`
+}
+
+func (g *GitHubActions) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	g.Count.Gets.Add(1)
+	prefix := githubActionsKeyPrefix(actionID)
+	var entry *githubActionsEntry
+	var err error
+	if g.twirpURL != "" {
+		entry, err = g.lookupV2(ctx, prefix)
+	} else {
+		entry, err = g.lookup(ctx, prefix)
+	}
+	if err != nil {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", g.Kind(), prefix, err)
+	}
+	if entry == nil {
+		g.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	outputID, ok := strings.CutPrefix(entry.CacheKey, prefix)
+	if !ok || outputID == "" {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (unexpected key %s)", g.Kind(), prefix, entry.CacheKey)
+	}
+
+	// The archive location is a pre-signed URL, it must not get the token.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, entry.ArchiveLocation, nil)
+	if err != nil {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", g.Kind(), entry.CacheKey, err)
+	}
+	resp, err := g.opts.Client.Do(req)
+	if err != nil {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", g.Kind(), entry.CacheKey, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// The entry was evicted since the lookup.
+		_ = resp.Body.Close()
+		g.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", g.Kind(), entry.CacheKey, githubActionsError(resp))
+	}
+	putTime := entry.CreationTime
+	if putTime.IsZero() {
+		// The v2 API does not return the creation time of entries.
+		putTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	}
+	if resp.ContentLength >= 0 {
+		return outputID, resp.ContentLength, putTime, resp.Body, nil
+	}
+	defer resp.Body.Close()
+	spooled, _, size, err := spool(resp.Body)
+	if err != nil {
+		g.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", g.Kind(), entry.CacheKey, err)
+	}
+	return outputID, size, putTime, spooled, nil
+}
+
+// lookup returns the newest committed entry whose key starts with prefix, or
+// nil if there is none.
+func (g *GitHubActions) lookup(ctx context.Context, prefix string) (*githubActionsEntry, error) {
+	query := url.Values{"keys": {prefix}, "version": {g.version}}
+	resp, err := g.do(ctx, http.MethodGet, g.baseURL+"/cache?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, githubActionsError(resp)
+	}
+	defer resp.Body.Close()
+	var entry githubActionsEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		return nil, err
+	}
+	if entry.ArchiveLocation == "" {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// lookupV2 is lookup with the cache service v2, where the prefix is matched as
+// a restore key.
+func (g *GitHubActions) lookupV2(ctx context.Context, prefix string) (*githubActionsEntry, error) {
+	var res struct {
+		OK                bool   `json:"ok"`
+		SignedDownloadURL string `json:"signed_download_url"`
+		MatchedKey        string `json:"matched_key"`
+	}
+	status, err := g.twirp(ctx, "GetCacheEntryDownloadURL", map[string]any{
+		"key":          prefix,
+		"restore_keys": []string{prefix},
+		"version":      g.version,
+	}, &res)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.OK || res.SignedDownloadURL == "" {
+		return nil, nil
+	}
+	return &githubActionsEntry{CacheKey: res.MatchedKey, ArchiveLocation: res.SignedDownloadURL}, nil
+}
+
+func (g *GitHubActions) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	g.Count.Puts.Add(1)
+	key := githubActionsKeyPrefix(actionID) + outputID
+	var reserved bool
+	var err error
+	if g.twirpURL != "" {
+		reserved, err = g.putV2(ctx, key, size, body)
+	} else {
+		reserved, err = g.put(ctx, key, size, body)
+	}
+	if err != nil {
+		g.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (size: %d): %w", g.Kind(), key, size, err)
+	}
+	if !reserved {
+		// The key exists or another job is uploading it, with the same output.
+		g.reserved.Add(1)
+		if g.verbose {
+			log.Printf("[%s] put skipped for %s, already reserved", g.Kind(), key)
+		}
+		return nil
+	}
+	if g.verbose {
+		log.Printf("[%s] put success for %s (size: %d)", g.Kind(), key, size)
+	}
+	return nil
+}
+
+// put reserves key with the legacy API, then uploads the body. It reports
+// false if the key is already reserved.
+func (g *GitHubActions) put(ctx context.Context, key string, size int64, body io.Reader) (bool, error) {
+	cacheID, err := g.reserve(ctx, key, size)
+	if err != nil || cacheID == 0 {
+		return false, err
+	}
+	return true, g.upload(ctx, cacheID, size, body)
+}
+
+// putV2 creates the entry of key with the cache service v2, uploads the body
+// to its signed URL with the Azure Blob Storage client, and then finalizes
+// the entry. It reports false if the entry already exists.
+func (g *GitHubActions) putV2(ctx context.Context, key string, size int64, body io.Reader) (bool, error) {
+	var created struct {
+		OK              bool   `json:"ok"`
+		SignedUploadURL string `json:"signed_upload_url"`
+	}
+	status, err := g.twirp(ctx, "CreateCacheEntry", map[string]any{
+		"key":     key,
+		"version": g.version,
+	}, &created)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !created.OK || created.SignedUploadURL == "" {
+		return false, nil
+	}
+
+	client, err := blockblob.NewClientWithNoCredential(created.SignedUploadURL, &blockblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{Transport: g.opts.Client},
+	})
+	if err != nil {
+		return false, err
+	}
+	cr := &countingReader{r: body}
+	if _, err := client.UploadStream(ctx, cr, nil); err != nil {
+		return false, err
+	}
+	if cr.n != size {
+		return false, fmt.Errorf("body is %d bytes", cr.n)
+	}
+
+	var finalized struct {
+		OK bool `json:"ok"`
+	}
+	if _, err := g.twirp(ctx, "FinalizeCacheEntryUpload", map[string]any{
+		"key":        key,
+		"size_bytes": size,
+		"version":    g.version,
+	}, &finalized); err != nil {
+		return false, err
+	}
+	if !finalized.OK {
+		return false, fmt.Errorf("entry not finalized")
+	}
+	return true, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// reserve reserves key for an upload and returns the ID of the reservation,
+// or zero if the key is already reserved or committed.
+func (g *GitHubActions) reserve(ctx context.Context, key string, size int64) (int64, error) {
+	resp, err := g.do(ctx, http.MethodPost, g.baseURL+"/caches", map[string]any{
+		"key":       key,
+		"version":   g.version,
+		"cacheSize": size,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return 0, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return 0, githubActionsError(resp)
+	}
+	defer resp.Body.Close()
+	var reservation struct {
+		CacheID int64 `json:"cacheId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+		return 0, err
+	}
+	if reservation.CacheID == 0 {
+		return 0, fmt.Errorf("no cache ID in the reservation")
+	}
+	return reservation.CacheID, nil
+}
+
+// upload uploads the body of a reserved entry in chunks, then commits it.
+func (g *GitHubActions) upload(ctx context.Context, cacheID int64, size int64, body io.Reader) error {
+	cacheURL := fmt.Sprintf("%s/caches/%d", g.baseURL, cacheID)
+	for offset := int64(0); offset < size; offset += githubActionsChunkSize {
+		n := min(githubActionsChunkSize, size-offset)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, cacheURL, io.LimitReader(body, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+n-1))
+		resp, err := g.send(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			return githubActionsError(resp)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	resp, err := g.do(ctx, http.MethodPost, cacheURL, map[string]int64{"size": size})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return githubActionsError(resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (g *GitHubActions) Close() error {
+	return nil
+}
+
+func (g *GitHubActions) Summary() string {
+	return g.Count.Summary(g.Kind()) + fmt.Sprintf("\n[%s] %d puts skipped as already reserved", g.Kind(), g.reserved.Load())
+}
@@ -0,0 +1,392 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeActionsToken = "runtime-token"
+
+// fakeActionsCache is a GitHub Actions cache service with both the legacy
+// _apis/artifactcache API and the twirp API of the cache service v2, whose
+// entries are stored in a fake Azure Blob Storage container.
+type fakeActionsCache struct {
+	*httptest.Server
+	blobs *fakeAzureBlobServer
+
+	mu      sync.Mutex
+	entries []*fakeActionsEntry
+}
+
+type fakeActionsEntry struct {
+	id        int
+	key       string
+	version   string
+	data      []byte // of the legacy API
+	committed bool
+	created   time.Time
+}
+
+func newFakeActionsCache(t *testing.T) *fakeActionsCache {
+	t.Helper()
+	f := &fakeActionsCache{blobs: newFakeAzureBlob(t, "actions")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_apis/artifactcache/cache", f.lookup)
+	mux.HandleFunc("POST /_apis/artifactcache/caches", f.reserve)
+	mux.HandleFunc("PATCH /_apis/artifactcache/caches/{id}", f.upload)
+	mux.HandleFunc("POST /_apis/artifactcache/caches/{id}", f.commit)
+	mux.HandleFunc("GET /archive/{id}", f.archive)
+	mux.HandleFunc("POST /twirp/github.actions.results.api.v1.CacheService/{method}", f.twirp)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeActionsCache) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+fakeActionsToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// find returns the entry of key and version, or the newest committed one
+// whose key starts with one of the prefixes. f.mu must be held.
+func (f *fakeActionsCache) find(key, version string, prefixes ...string) *fakeActionsEntry {
+	var found *fakeActionsEntry
+	for _, e := range f.entries {
+		if e.version != version {
+			continue
+		}
+		if e.key == key {
+			return e
+		}
+		for _, p := range prefixes {
+			if e.committed && strings.HasPrefix(e.key, p) && (found == nil || !e.created.Before(found.created)) {
+				found = e
+			}
+		}
+	}
+	return found
+}
+
+// create reserves key, or returns nil if it is taken. f.mu must be held.
+func (f *fakeActionsCache) create(key, version string) *fakeActionsEntry {
+	if f.find(key, version) != nil {
+		return nil
+	}
+	e := &fakeActionsEntry{id: len(f.entries) + 1, key: key, version: version}
+	f.entries = append(f.entries, e)
+	return e
+}
+
+func (f *fakeActionsCache) entry(r *http.Request) *fakeActionsEntry {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	if id < 1 || id > len(f.entries) {
+		return nil
+	}
+	return f.entries[id-1]
+}
+
+func (f *fakeActionsCache) lookup(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := r.URL.Query().Get("keys")
+	e := f.find("", r.URL.Query().Get("version"), prefix)
+	if e == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"cacheKey":        e.key,
+		"creationTime":    e.created,
+		"archiveLocation": fmt.Sprintf("%s/archive/%d", f.URL, e.id),
+	})
+}
+
+func (f *fakeActionsCache) reserve(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	var req struct {
+		Key     string `json:"key"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.create(req.Key, req.Version)
+	if e == nil {
+		http.Error(w, `{"message":"Cache already exists."}`, http.StatusConflict)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"cacheId": e.id})
+}
+
+func (f *fakeActionsCache) upload(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err != nil {
+		http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.entry(r)
+	if e == nil || e.committed || start != len(e.data) || end != start+len(data)-1 {
+		http.Error(w, "invalid chunk", http.StatusBadRequest)
+		return
+	}
+	e.data = append(e.data, data...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeActionsCache) commit(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	var req struct {
+		Size int `json:"size"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.entry(r)
+	if e == nil || e.committed || req.Size != len(e.data) {
+		http.Error(w, "invalid commit", http.StatusBadRequest)
+		return
+	}
+	e.committed = true
+	e.created = time.Now()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// archive serves the body of a legacy entry, like a pre-signed URL that must
+// not be sent the runtime token.
+func (f *fakeActionsCache) archive(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "" {
+		http.Error(w, "unexpected Authorization header", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.entry(r)
+	if e == nil || !e.committed {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write(e.data)
+}
+
+func twirpError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"code": code, "msg": msg})
+}
+
+func (f *fakeActionsCache) twirp(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	var req struct {
+		Key         string   `json:"key"`
+		Version     string   `json:"version"`
+		RestoreKeys []string `json:"restore_keys"`
+		SizeBytes   int      `json:"size_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		twirpError(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	blobURL := func(e *fakeActionsEntry, sig string) string {
+		return fmt.Sprintf("%s%sactions/%d?sig=%s", f.blobs.URL, fakeAzureAccount, e.id, sig)
+	}
+	var res any
+	switch r.PathValue("method") {
+	case "CreateCacheEntry":
+		e := f.create(req.Key, req.Version)
+		if e == nil {
+			twirpError(w, http.StatusConflict, "already_exists", "cache entry already exists")
+			return
+		}
+		res = map[string]any{"ok": true, "signed_upload_url": blobURL(e, "upload")}
+	case "FinalizeCacheEntryUpload":
+		e := f.find(req.Key, req.Version)
+		if e == nil || e.committed {
+			twirpError(w, http.StatusNotFound, "not_found", "cache entry not found")
+			return
+		}
+		f.blobs.mu.Lock()
+		blob, ok := f.blobs.blobs[fmt.Sprintf("actions/%d", e.id)]
+		f.blobs.mu.Unlock()
+		if !ok || len(blob.data) != req.SizeBytes {
+			res = map[string]any{"ok": false}
+			break
+		}
+		e.committed = true
+		e.created = time.Now()
+		res = map[string]any{"ok": true, "entry_id": strconv.Itoa(e.id)}
+	case "GetCacheEntryDownloadURL":
+		e := f.find(req.Key, req.Version, req.RestoreKeys...)
+		if e == nil || !e.committed {
+			res = map[string]any{"ok": false}
+			break
+		}
+		res = map[string]any{"ok": true, "signed_download_url": blobURL(e, "download"), "matched_key": e.key}
+	default:
+		twirpError(w, http.StatusNotFound, "bad_route", "no such method")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func newTestGitHubActions(t *testing.T, f *fakeActionsCache, v2 bool) *GitHubActions {
+	t.Helper()
+	opts := GitHubActionsOptions{Token: fakeActionsToken}
+	if v2 {
+		opts.ResultsURL = f.URL + "/"
+	} else {
+		opts.URL = f.URL
+	}
+	g := NewGitHubActions(opts, "v1", false)
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGitHubActions(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v2=%v", v2), func(t *testing.T) {
+			t.Run("PutGet", func(t *testing.T) { testGitHubActionsPutGet(t, v2) })
+			t.Run("Reserved", func(t *testing.T) { testGitHubActionsReserved(t, v2) })
+			t.Run("Newest", func(t *testing.T) { testGitHubActionsNewest(t, v2) })
+		})
+	}
+}
+
+func githubActionsPut(t *testing.T, g *GitHubActions, actionID string, data []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := g.Put(context.Background(), actionID, outputID, int64(len(data)), bytesReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return outputID
+}
+
+func githubActionsGet(t *testing.T, g *GitHubActions, actionID string) (string, []byte) {
+	t.Helper()
+	outputID, size, putTime, body, err := g.Get(context.Background(), actionID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if body == nil {
+		return "", nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("Get size = %d, read %d bytes", size, len(data))
+	}
+	if putTime.IsZero() {
+		t.Errorf("Get: no put time")
+	}
+	return outputID, data
+}
+
+func testGitHubActionsPutGet(t *testing.T, v2 bool) {
+	f := newFakeActionsCache(t)
+	g := newTestGitHubActions(t, f, v2)
+	if outputID, _ := githubActionsGet(t, g, actionIDOf("a")); outputID != "" {
+		t.Fatalf("Get before Put = %s, want a miss", outputID)
+	}
+	data := []byte("hello, world")
+	// Larger than a chunk of the legacy API and a block of the Azure client.
+	large := bytes.Repeat([]byte("0123456789abcdef"), (githubActionsChunkSize+1<<20)/16)
+	for name, data := range map[string][]byte{"a": data, "empty": nil, "large": large} {
+		outputID := githubActionsPut(t, g, actionIDOf(name), data)
+		gotOutputID, got := githubActionsGet(t, g, actionIDOf(name))
+		if gotOutputID != outputID || !bytes.Equal(got, data) {
+			t.Errorf("Get %s = %s, %d bytes; want %s, %d bytes", name, gotOutputID, len(got), outputID, len(data))
+		}
+	}
+	if g.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", g.Count.Misses.Load())
+	}
+}
+
+// A key that is already reserved by another job is skipped, not an error.
+func testGitHubActionsReserved(t *testing.T, v2 bool) {
+	f := newFakeActionsCache(t)
+	g := newTestGitHubActions(t, f, v2)
+	data := []byte("data")
+	githubActionsPut(t, g, actionIDOf("a"), data)
+	githubActionsPut(t, g, actionIDOf("a"), data)
+	if g.reserved.Load() != 1 || g.Count.PutErrors.Load() != 0 {
+		t.Errorf("reserved = %d, PutErrors = %d; want 1 and 0", g.reserved.Load(), g.Count.PutErrors.Load())
+	}
+	if len(f.entries) != 1 {
+		t.Errorf("%d entries, want 1", len(f.entries))
+	}
+}
+
+// Entries cannot be overwritten, so a new output is a new entry, which gets
+// return.
+func testGitHubActionsNewest(t *testing.T, v2 bool) {
+	f := newFakeActionsCache(t)
+	g := newTestGitHubActions(t, f, v2)
+	githubActionsPut(t, g, actionIDOf("a"), []byte("old"))
+	time.Sleep(time.Millisecond)
+	outputID := githubActionsPut(t, g, actionIDOf("a"), []byte("new"))
+	if gotOutputID, got := githubActionsGet(t, g, actionIDOf("a")); gotOutputID != outputID || string(got) != "new" {
+		t.Errorf("Get = %s, %q; want %s, %q", gotOutputID, got, outputID, "new")
+	}
+
+	// Another bucket path is another version, which does not see the entries.
+	other := NewGitHubActions(g.opts, "v2", false)
+	if outputID, _ := githubActionsGet(t, other, actionIDOf("a")); outputID != "" {
+		t.Errorf("Get with another cache key = %s, want a miss", outputID)
+	}
+}
+
+func TestGitHubActionsUnauthorized(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		f := newFakeActionsCache(t)
+		g := newTestGitHubActions(t, f, v2)
+		g.opts.Token = "wrong"
+		if _, _, _, _, err := g.Get(context.Background(), actionIDOf("a")); err == nil {
+			t.Errorf("v2=%v: Get with a wrong token succeeded", v2)
+		}
+		if err := g.Put(context.Background(), actionIDOf("a"), actionIDOf(""), 0, bytes.NewReader(nil)); err == nil {
+			t.Errorf("v2=%v: Put with a wrong token succeeded", v2)
+		}
+	}
+}
@@ -8,23 +8,62 @@ import (
 	"log"
 	"os"
 	"path"
-	"runtime"
+	"time"
 
 	"github.com/reillywatson/gocache/storage/count"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
 )
 
-func NewGoogleCloudStorageClient(ctx context.Context) (*storage.Client, error) {
-	client, err := storage.NewClient(ctx)
+// GoogleCloudStorageOptions configures the Google Cloud Storage client.
+type GoogleCloudStorageOptions struct {
+	// Endpoint overrides the JSON API endpoint, e.g.
+	// http://localhost:4443/storage/v1/ for fake-gcs-server. The
+	// STORAGE_EMULATOR_HOST environment variable, which also disables
+	// authentication, is honored as well.
+	Endpoint string
+	// CredentialsFile is a service account or external account JSON file
+	// used instead of the Application Default Credentials.
+	CredentialsFile string
+	// Anonymous sends unauthenticated requests, for public buckets and emulators.
+	Anonymous bool
+	// SkipBucketCheck skips the check that the bucket exists on start, which
+	// needs the storage.buckets.get permission.
+	SkipBucketCheck bool
+	// Prefix is prepended to the names of the objects.
+	Prefix string
+}
+
+func NewGoogleCloudStorageClient(ctx context.Context, opts GoogleCloudStorageOptions) (*storage.Client, error) {
+	var clientOpts []option.ClientOption
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Endpoint != "" || os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		// Reads use the XML API by default, which emulators and custom
+		// endpoints may not serve.
+		clientOpts = append(clientOpts, storage.WithJSONReads())
+	}
+	switch {
+	case opts.Anonymous && opts.CredentialsFile != "":
+		return nil, fmt.Errorf("a credentials file cannot be used in anonymous mode")
+	case opts.Anonymous:
+		clientOpts = append(clientOpts, option.WithoutAuthentication())
+	case opts.CredentialsFile != "":
+		clientOpts = append(clientOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+	client, err := storage.NewClient(ctx, clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Google Cloud Storage client: %w", err)
 	}
 	return client, nil
-
 }
 
-var _ Storage = &GoogleCloudStorage{}
+var (
+	_ Storage    = &GoogleCloudStorage{}
+	_ PutSkipper = &GoogleCloudStorage{}
+)
 
 // GoogleCloudStorage is a remote cache that is backed by a Google Cloud Storage bucket
 type GoogleCloudStorage struct {
@@ -32,32 +71,21 @@ type GoogleCloudStorage struct {
 	bucketName string
 	bucket     *storage.BucketHandle
 	bucketPath string
+	opts       GoogleCloudStorageOptions
 	verbose    bool
 	count.Count
 }
 
 // NewGoogleCloudStorage creates a new GoogleCloudStorage instance.
-func NewGoogleCloudStorage(client *storage.Client, bucketName string, cacheKey string, verbose bool) *GoogleCloudStorage {
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		goarch = runtime.GOARCH
-	}
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		goos = runtime.GOOS
-	}
-	goVersion := os.Getenv("GOVERSION")
-	if goVersion == "" {
-		goVersion = runtime.Version()
-	}
-
-	bucketPath := path.Join("cache", cacheKey, goarch, goos, goVersion)
+func NewGoogleCloudStorage(client *storage.Client, bucketName string, cacheKey string, opts GoogleCloudStorageOptions, verbose bool) *GoogleCloudStorage {
+	bucketPath := path.Join(opts.Prefix, BucketPath(cacheKey))
 
 	return &GoogleCloudStorage{
 		client:     client,
 		bucket:     client.Bucket(bucketName),
 		bucketName: bucketName,
 		bucketPath: bucketPath,
+		opts:       opts,
 		verbose:    verbose,
 	}
 }
@@ -78,13 +106,16 @@ func (g *GoogleCloudStorage) Start(ctx context.Context) error {
 	if g.verbose {
 		log.Printf("[%s] start to %s", g.Kind(), g.bucketFullPath())
 	}
+	if g.opts.SkipBucketCheck {
+		return nil
+	}
 	if _, err := g.bucket.Attrs(ctx); err != nil {
 		return fmt.Errorf("[%s] failed to start %s: %w", g.Kind(), g.bucketFullPath(), err)
 	}
 	return nil
 }
 
-func (g *GoogleCloudStorage) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+func (g *GoogleCloudStorage) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
 	g.Count.Gets.Add(1)
 	objectName := g.objectName(actionID)
 	obj := g.bucket.Object(objectName)
@@ -92,29 +123,29 @@ func (g *GoogleCloudStorage) Get(ctx context.Context, actionID string) (string,
 	attrs, err := obj.Attrs(ctx)
 	if errors.Is(err, storage.ErrObjectNotExist) {
 		g.Count.Misses.Add(1)
-		return "", 0, nil, nil
+		return "", 0, time.Time{}, nil, nil
 	}
 	if err != nil {
 		g.Count.GetErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("[%s] get %s/%s (%v)", g.Kind(), g.bucketFullPath(), actionID, err)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (%v)", g.Kind(), g.bucketFullPath(), actionID, err)
 	}
 
 	outputID, ok := attrs.Metadata[outputIDMetadataKey]
 	if !ok || outputID == "" {
 		g.Count.GetErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("[%s] get %s/%s (outputID not found in GCS metadata for object)", g.Kind(), g.bucketFullPath(), actionID)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (outputID not found in GCS metadata for object)", g.Kind(), g.bucketFullPath(), actionID)
 	}
 
 	reader, err := obj.NewReader(ctx)
 	if err != nil {
 		g.Count.GetErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("[%s] get %s/%s (failed to create GCS reader): %w", g.Kind(), g.bucketFullPath(), actionID, err)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (failed to create GCS reader): %w", g.Kind(), g.bucketFullPath(), actionID, err)
 	}
 
 	if g.verbose {
 		log.Printf("[%s] get success %s/%s (size: %v)", g.Kind(), g.bucketFullPath(), actionID, attrs.Size)
 	}
-	return outputID, attrs.Size, reader, nil
+	return outputID, attrs.Size, attrs.Created, reader, nil
 }
 
 func (g *GoogleCloudStorage) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
@@ -141,6 +172,21 @@ func (g *GoogleCloudStorage) Put(ctx context.Context, actionID, outputID string,
 	return nil
 }
 
+func (g *GoogleCloudStorage) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	attrs, err := g.bucket.Object(g.objectName(actionID)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[%s] attrs %s/%s (%v)", g.Kind(), g.bucketFullPath(), actionID, err)
+	}
+	if attrs.Metadata[outputIDMetadataKey] != outputID || attrs.Size != size {
+		return false, nil
+	}
+	g.Count.SkippedPuts.Add(1)
+	return true, nil
+}
+
 func (g *GoogleCloudStorage) Close() error {
 	err := g.client.Close()
 	if err != nil {
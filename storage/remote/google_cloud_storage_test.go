@@ -0,0 +1,186 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS implements the subset of the Cloud Storage JSON API that
+// GoogleCloudStorage uses, for a single bucket.
+type fakeGCS struct {
+	*httptest.Server
+	bucket string
+
+	mu       sync.Mutex
+	objects  map[string]fakeGCSObject
+	requests []string // method and path of the requests
+	auths    []string // Authorization headers of the requests
+}
+
+type fakeGCSObject struct {
+	data     []byte
+	metadata map[string]string
+	created  time.Time
+}
+
+func newFakeGCS(t *testing.T, bucket string) *fakeGCS {
+	t.Helper()
+	f := &fakeGCS{bucket: bucket, objects: map[string]fakeGCSObject{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func gcsError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, http.StatusText(status))
+}
+
+func (f *fakeGCS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.auths = append(f.auths, r.Header.Get("Authorization"))
+
+	bucketPath := "/storage/v1/b/" + f.bucket
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == bucketPath:
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"kind":"storage#bucket","name":%q}`, f.bucket)
+	case r.Method == http.MethodPost && r.URL.Path == "/upload"+bucketPath+"/o":
+		f.upload(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, bucketPath+"/o/"):
+		name := strings.TrimPrefix(r.URL.Path, bucketPath+"/o/")
+		obj, ok := f.objects[name]
+		if !ok {
+			gcsError(w, http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+			_, _ = w.Write(obj.data)
+			return
+		}
+		f.writeObject(w, name, obj)
+	default:
+		gcsError(w, http.StatusNotFound)
+	}
+}
+
+// upload stores the object of a multipart upload. f.mu must be held.
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		gcsError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var attrs struct {
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&attrs)
+	}
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(part)
+	}
+	if err != nil {
+		gcsError(w, http.StatusBadRequest)
+		return
+	}
+	obj := fakeGCSObject{data: data, metadata: attrs.Metadata, created: time.Now()}
+	f.objects[attrs.Name] = obj
+	f.writeObject(w, attrs.Name, obj)
+}
+
+func (f *fakeGCS) writeObject(w http.ResponseWriter, name string, obj fakeGCSObject) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"kind":        "storage#object",
+		"bucket":      f.bucket,
+		"name":        name,
+		"size":        fmt.Sprint(len(obj.data)),
+		"metadata":    obj.metadata,
+		"timeCreated": obj.created.UTC().Format(time.RFC3339Nano),
+		"generation":  "1",
+	})
+}
+
+func newTestGCS(t *testing.T, bucket string, opts GoogleCloudStorageOptions) (*GoogleCloudStorage, error) {
+	t.Helper()
+	client, err := NewGoogleCloudStorageClient(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	g := NewGoogleCloudStorage(client, bucket, "v1", opts, false)
+	t.Cleanup(func() { _ = g.Close() })
+	return g, g.Start(context.Background())
+}
+
+// A custom endpoint, such as that of fake-gcs-server, is used for the JSON
+// API, reads included.
+func TestGoogleCloudStorageEndpoint(t *testing.T) {
+	f := newFakeGCS(t, "bucket")
+	g, err := newTestGCS(t, "bucket", GoogleCloudStorageOptions{Endpoint: f.URL + "/storage/v1/", Anonymous: true})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	testStorage(t, g)
+	for i, auth := range f.auths {
+		if auth != "" {
+			t.Errorf("request %s is authenticated in anonymous mode", f.requests[i])
+		}
+	}
+}
+
+// STORAGE_EMULATOR_HOST sends the requests to an emulator, without
+// authentication.
+func TestGoogleCloudStorageEmulator(t *testing.T) {
+	f := newFakeGCS(t, "bucket")
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(f.URL, "http://"))
+	g, err := newTestGCS(t, "bucket", GoogleCloudStorageOptions{})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	putGet(t, g, actionIDOf("a"), []byte("hello, world"))
+	if len(f.requests) == 0 || f.requests[0] != "GET /storage/v1/b/bucket" {
+		t.Errorf("requests = %q, want the bucket check first", f.requests)
+	}
+}
+
+func TestGoogleCloudStorageBucketCheck(t *testing.T) {
+	f := newFakeGCS(t, "bucket")
+	opts := GoogleCloudStorageOptions{Endpoint: f.URL + "/storage/v1/", Anonymous: true}
+	if _, err := newTestGCS(t, "other", opts); err == nil {
+		t.Errorf("Start succeeded without the bucket")
+	}
+	opts.SkipBucketCheck = true
+	n := len(f.requests)
+	if _, err := newTestGCS(t, "other", opts); err != nil || len(f.requests) != n {
+		t.Errorf("Start = %v after %d requests; want no bucket check", err, len(f.requests)-n)
+	}
+}
+
+func TestGoogleCloudStorageAnonymousCredentials(t *testing.T) {
+	_, err := NewGoogleCloudStorageClient(context.Background(), GoogleCloudStorageOptions{Anonymous: true, CredentialsFile: "key.json"})
+	if err == nil {
+		t.Errorf("a credentials file was accepted in anonymous mode")
+	}
+}
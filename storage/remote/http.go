@@ -0,0 +1,375 @@
+package remote
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// outputIDHeader is the HTTP header that carries the OutputID of an object.
+const outputIDHeader = "X-Gocache-Outputid"
+
+// HTTPOptions configures the requests of an HTTP remote cache.
+type HTTPOptions struct {
+	// BearerToken is sent in the Authorization header, if set.
+	BearerToken string
+	// Username and Password are sent as basic auth, if set.
+	Username string
+	Password string
+	// Header is added to every request.
+	Header http.Header
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// BazelRemote uses the layout of bazel-remote: the body of an object is
+	// stored under <base>/cas/<outputID>, and the action under
+	// <base>/ac/<actionID> as an ActionResult that references it, the same
+	// way as the Remote Execution API cache.
+	BazelRemote bool
+}
+
+var (
+	_ Storage    = &HTTP{}
+	_ PutSkipper = &HTTP{}
+)
+
+// HTTP is a remote cache that is backed by a plain HTTP cache server that
+// supports GET, HEAD and PUT of <base>/<actionID>, such as nginx with WebDAV,
+// or by the /ac/ and /cas/ layout of bazel-remote.
+//
+// The OutputID is sent in a header. Servers that do not store headers, like
+// nginx, still work: the OutputID of an object is the SHA-256 of its body, so
+// it is computed on download when the header is missing.
+type HTTP struct {
+	baseURL string
+	opts    HTTPOptions
+	verbose bool
+	count.Count
+}
+
+func NewHTTP(baseURL string, opts HTTPOptions, verbose bool) *HTTP {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return &HTTP{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		opts:    opts,
+		verbose: verbose,
+	}
+}
+
+func (h *HTTP) objectURL(actionID string) string {
+	if h.opts.BazelRemote {
+		return fmt.Sprintf("%s/ac/%s", h.baseURL, actionID)
+	}
+	return fmt.Sprintf("%s/%s", h.baseURL, actionID)
+}
+
+func (h *HTTP) casURL(outputID string) string {
+	return fmt.Sprintf("%s/cas/%s", h.baseURL, outputID)
+}
+
+// redactedURL is the base URL without credentials, for logging.
+func (h *HTTP) redactedURL() string {
+	u, err := url.Parse(h.baseURL)
+	if err != nil {
+		return h.baseURL
+	}
+	return u.Redacted()
+}
+
+func (h *HTTP) Kind() string {
+	return "http"
+}
+
+func (h *HTTP) Start(context.Context) error {
+	if h.verbose {
+		layout := ""
+		if h.opts.BazelRemote {
+			layout = " (bazel-remote layout)"
+		}
+		log.Printf("[%s] configured to %s%s", h.Kind(), h.redactedURL(), layout)
+	}
+	return nil
+}
+
+func (h *HTTP) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range h.opts.Header {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	switch {
+	case h.opts.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+h.opts.BearerToken)
+	case h.opts.Username != "" || h.opts.Password != "":
+		req.SetBasicAuth(h.opts.Username, h.opts.Password)
+	}
+	return req, nil
+}
+
+// get sends a GET request. It returns a nil response if the object is not found.
+func (h *HTTP) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := h.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, nil
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// put sends a PUT request of size bytes.
+func (h *HTTP) put(ctx context.Context, url, outputID string, size int64, body io.Reader) error {
+	req, err := h.newRequest(ctx, http.MethodPut, url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set(outputIDHeader, outputID)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := h.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *HTTP) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	h.Count.Gets.Add(1)
+	var outputID string
+	var size int64
+	var putTime time.Time
+	var body io.ReadCloser
+	var err error
+	if h.opts.BazelRemote {
+		outputID, size, putTime, body, err = h.getBazelRemote(ctx, actionID)
+	} else {
+		outputID, size, putTime, body, err = h.getObject(ctx, actionID)
+	}
+	if err != nil {
+		h.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s/%s (%v)", h.Kind(), h.redactedURL(), actionID, err)
+	}
+	if body == nil {
+		h.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	return outputID, size, putTime, body, nil
+}
+
+// getObject reads <base>/<actionID>. The body is nil if there is no object.
+func (h *HTTP) getObject(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	resp, err := h.get(ctx, h.objectURL(actionID))
+	if err != nil || resp == nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	putTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	outputID := resp.Header.Get(outputIDHeader)
+	if outputID != "" && resp.ContentLength >= 0 {
+		return outputID, resp.ContentLength, putTime, resp.Body, nil
+	}
+	// The server did not store the OutputID or did not send the size; spool
+	// the body to compute them.
+	defer resp.Body.Close()
+	spooled, sum, size, err := spool(resp.Body)
+	if err != nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	return cmp.Or(outputID, sum), size, putTime, spooled, nil
+}
+
+// getBazelRemote reads the action result of actionID, then the body that it
+// references. The body is nil if either is missing.
+func (h *HTTP) getBazelRemote(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	result, err := h.getActionResult(ctx, actionID)
+	if err != nil || result == nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	outputID, digest, putTime, err := parseActionResult(result)
+	if err != nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	if digest.GetSizeBytes() == 0 {
+		return outputID, 0, putTime, io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	resp, err := h.get(ctx, h.casURL(digest.GetHash()))
+	if err != nil || resp == nil {
+		return "", 0, time.Time{}, nil, err
+	}
+	return outputID, digest.GetSizeBytes(), putTime, resp.Body, nil
+}
+
+// getActionResult reads <base>/ac/<actionID>, or returns nil if it is missing.
+func (h *HTTP) getActionResult(ctx context.Context, actionID string) (*repb.ActionResult, error) {
+	resp, err := h.get(ctx, h.objectURL(actionID))
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result repb.ActionResult
+	if err := proto.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid action result: %w", err)
+	}
+	return &result, nil
+}
+
+func (h *HTTP) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	h.Count.Puts.Add(1)
+	var err error
+	if h.opts.BazelRemote {
+		err = h.putBazelRemote(ctx, actionID, outputID, size, body)
+	} else {
+		err = h.put(ctx, h.objectURL(actionID), outputID, size, body)
+	}
+	if err != nil {
+		h.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s/%s (outputID: %s, size: %d): %w", h.Kind(), h.redactedURL(), actionID, outputID, size, err)
+	}
+	if h.verbose {
+		log.Printf("[%s] put success for %s/%s (outputID: %s, size: %d)", h.Kind(), h.redactedURL(), actionID, outputID, size)
+	}
+	return nil
+}
+
+// putBazelRemote uploads the body to the CAS, where bazel-remote checks it
+// against its digest, the OutputID, then the action result that references it.
+func (h *HTTP) putBazelRemote(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if size > 0 {
+		if err := h.put(ctx, h.casURL(outputID), outputID, size, body); err != nil {
+			return err
+		}
+	}
+	data, err := proto.Marshal(newActionResult(outputID, &repb.Digest{Hash: outputID, SizeBytes: size}))
+	if err != nil {
+		return err
+	}
+	return h.put(ctx, h.objectURL(actionID), outputID, int64(len(data)), bytes.NewReader(data))
+}
+
+// Head reports the OutputID and size of the object stored for actionID,
+// without downloading it. found is false if there is none. The OutputID is
+// empty if the server did not store it.
+func (h *HTTP) Head(ctx context.Context, actionID string) (outputID string, size int64, found bool, err error) {
+	if h.opts.BazelRemote {
+		result, err := h.getActionResult(ctx, actionID)
+		if err == nil && result != nil {
+			var digest *repb.Digest
+			outputID, digest, _, err = parseActionResult(result)
+			size = digest.GetSizeBytes()
+		}
+		if err != nil {
+			return "", 0, false, fmt.Errorf("[%s] head %s/%s (%v)", h.Kind(), h.redactedURL(), actionID, err)
+		}
+		return outputID, size, result != nil, nil
+	}
+	req, err := h.newRequest(ctx, http.MethodHead, h.objectURL(actionID), nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	resp, err := h.opts.Client.Do(req)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("[%s] head %s/%s (%v)", h.Kind(), h.redactedURL(), actionID, err)
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get(outputIDHeader), resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return "", 0, false, nil
+	default:
+		return "", 0, false, fmt.Errorf("[%s] head %s/%s (unexpected status %s)", h.Kind(), h.redactedURL(), actionID, resp.Status)
+	}
+}
+
+// SkipPut reports whether the server already stores outputID for actionID.
+// Objects stored without their OutputID are always uploaded again.
+func (h *HTTP) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	storedOutputID, storedSize, found, err := h.Head(ctx, actionID)
+	if err != nil || !found || storedOutputID != outputID || storedSize != size {
+		return false, err
+	}
+	h.Count.SkippedPuts.Add(1)
+	return true, nil
+}
+
+func (h *HTTP) Close() error {
+	return nil
+}
+
+func (h *HTTP) Summary() string {
+	return h.Count.Summary(h.Kind())
+}
+
+// spool copies r to a temporary file, and returns a reader of the file that
+// removes it on Close, along with the hex SHA-256 and the size of the data.
+func spool(r io.Reader) (io.ReadCloser, string, int64, error) {
+	f, err := os.CreateTemp("", "gocache-*")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, "", 0, err
+	}
+	return &tempFile{f}, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// tempFile is a temporary file that is removed on Close.
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	_ = os.Remove(t.File.Name())
+	return err
+}
@@ -0,0 +1,333 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeHTTPServer is an HTTP cache server that keeps the bodies of PUT
+// requests in memory, along with their OutputID header if keepOutputID is
+// set. With bazelRemote, it only accepts the /ac/ and /cas/ layout of
+// bazel-remote and validates the entries like it does.
+type fakeHTTPServer struct {
+	*httptest.Server
+	keepOutputID bool
+	bazelRemote  bool
+	auth         string // expected Authorization header, if set
+
+	mu      sync.Mutex
+	objects map[string]fakeHTTPObject
+}
+
+type fakeHTTPObject struct {
+	body     []byte
+	outputID string
+}
+
+var bazelRemotePath = regexp.MustCompile(`^/(?:.*/)?(ac|cas)/([0-9a-f]{64})$`)
+
+func newFakeHTTPServer(t *testing.T, keepOutputID, bazelRemote bool, auth string) *fakeHTTPServer {
+	t.Helper()
+	f := &fakeHTTPServer{keepOutputID: keepOutputID, bazelRemote: bazelRemote, auth: auth, objects: map[string]fakeHTTPObject{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHTTPServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.auth != "" && r.Header.Get("Authorization") != f.auth {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.validate(r.URL.Path, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj := fakeHTTPObject{body: body}
+		if f.keepOutputID {
+			obj.outputID = r.Header.Get(outputIDHeader)
+		}
+		f.objects[r.URL.Path] = obj
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if obj.outputID != "" {
+			w.Header().Set(outputIDHeader, obj.outputID)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(obj.body)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validate checks a PUT the way bazel-remote does: CAS blobs must match their
+// digest, and action results must be valid and reference blobs in the CAS.
+func (f *fakeHTTPServer) validate(urlPath string, body []byte) error {
+	if !f.bazelRemote {
+		return nil
+	}
+	m := bazelRemotePath.FindStringSubmatch(urlPath)
+	if m == nil {
+		return fmt.Errorf("invalid path %s", urlPath)
+	}
+	if m[1] == "cas" {
+		if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != m[2] {
+			return fmt.Errorf("blob does not match its digest %s", m[2])
+		}
+		return nil
+	}
+	var result repb.ActionResult
+	if err := proto.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	for _, file := range result.GetOutputFiles() {
+		d := file.GetDigest()
+		if d.GetSizeBytes() == 0 {
+			continue
+		}
+		casPath := strings.TrimSuffix(urlPath, "/ac/"+m[2]) + "/cas/" + d.GetHash()
+		if _, ok := f.objects[casPath]; !ok {
+			return fmt.Errorf("action result references missing blob %s", d.GetHash())
+		}
+	}
+	return nil
+}
+
+// putGet puts an object in s, then gets it back and checks it.
+func putGet(t *testing.T, s Storage, actionID string, data []byte) {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := s.Put(ctx, actionID, outputID, int64(len(data)), bytesReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	gotOutputID, size, _, body, err := s.Get(ctx, actionID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if body == nil {
+		t.Fatalf("Get: miss after Put")
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if gotOutputID != outputID || size != int64(len(data)) || string(got) != string(data) {
+		t.Errorf("Get = %s, %d, %q; want %s, %d, %q", gotOutputID, size, got, outputID, len(data), data)
+	}
+}
+
+func bytesReader(data []byte) io.Reader {
+	return &readerOnly{data: data}
+}
+
+// readerOnly is a reader that is not an io.Seeker, like a streamed body.
+type readerOnly struct {
+	data []byte
+}
+
+func (r *readerOnly) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func actionIDOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHTTPPutGet(t *testing.T) {
+	for _, keepOutputID := range []bool{true, false} {
+		t.Run(fmt.Sprintf("keepOutputID=%v", keepOutputID), func(t *testing.T) {
+			srv := newFakeHTTPServer(t, keepOutputID, false, "")
+			h := NewHTTP(srv.URL+"/cache", HTTPOptions{}, false)
+			putGet(t, h, actionIDOf("a"), []byte("hello, world"))
+			putGet(t, h, actionIDOf("empty"), nil)
+			if _, ok := srv.objects["/cache/"+actionIDOf("a")]; !ok {
+				t.Errorf("object not stored under <base>/<actionID>")
+			}
+		})
+	}
+}
+
+func TestHTTPMiss(t *testing.T) {
+	srv := newFakeHTTPServer(t, true, false, "")
+	h := NewHTTP(srv.URL, HTTPOptions{}, false)
+	outputID, _, _, body, err := h.Get(context.Background(), actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if h.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", h.Count.Misses.Load())
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    HTTPOptions
+		wantErr bool
+	}{
+		{"bearer", HTTPOptions{BearerToken: "secret"}, false},
+		{"basic", HTTPOptions{Username: "user", Password: "pass"}, false},
+		{"header", HTTPOptions{Header: http.Header{"Authorization": {"Bearer secret"}}}, false},
+		{"wrong token", HTTPOptions{BearerToken: "other"}, true},
+		{"none", HTTPOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := "Bearer secret"
+			if tt.opts.Username != "" {
+				auth = "Basic dXNlcjpwYXNz"
+			}
+			srv := newFakeHTTPServer(t, true, false, auth)
+			h := NewHTTP(srv.URL, HTTPOptions{}, false)
+			h.opts = tt.opts
+			h.opts.Client = http.DefaultClient
+			err := h.Put(context.Background(), actionIDOf("a"), actionIDOf("o"), 1, bytesReader([]byte("x")))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Put error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				putGet(t, h, actionIDOf("b"), []byte("data"))
+			}
+		})
+	}
+}
+
+func TestHTTPBazelRemote(t *testing.T) {
+	srv := newFakeHTTPServer(t, false, true, "")
+	h := NewHTTP(srv.URL+"/instance", HTTPOptions{BazelRemote: true}, false)
+	actionID := actionIDOf("a")
+	data := []byte("hello, bazel-remote")
+	putGet(t, h, actionID, data)
+	putGet(t, h, actionIDOf("empty"), nil)
+
+	sum := sha256.Sum256(data)
+	if _, ok := srv.objects["/instance/cas/"+hex.EncodeToString(sum[:])]; !ok {
+		t.Errorf("body not stored under <base>/cas/<outputID>")
+	}
+	if _, ok := srv.objects["/instance/ac/"+actionID]; !ok {
+		t.Errorf("action not stored under <base>/ac/<actionID>")
+	}
+
+	outputID, _, _, body, err := h.Get(context.Background(), actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+
+	skip, err := h.SkipPut(context.Background(), actionID, hex.EncodeToString(sum[:]), int64(len(data)))
+	if err != nil || !skip {
+		t.Errorf("SkipPut = %v, %v; want true", skip, err)
+	}
+}
+
+func TestHTTPSkipPut(t *testing.T) {
+	srv := newFakeHTTPServer(t, true, false, "")
+	h := NewHTTP(srv.URL, HTTPOptions{}, false)
+	ctx := context.Background()
+	data := []byte("data")
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if skip, err := h.SkipPut(ctx, actionIDOf("a"), outputID, 4); err != nil || skip {
+		t.Fatalf("SkipPut before Put = %v, %v; want false", skip, err)
+	}
+	putGet(t, h, actionIDOf("a"), data)
+	if skip, err := h.SkipPut(ctx, actionIDOf("a"), outputID, 4); err != nil || !skip {
+		t.Errorf("SkipPut after Put = %v, %v; want true", skip, err)
+	}
+	if skip, _ := h.SkipPut(ctx, actionIDOf("a"), actionIDOf("other"), 4); skip {
+		t.Errorf("SkipPut of another output = true, want false")
+	}
+	if n := h.Count.SkippedPuts.Load(); n != 1 {
+		t.Errorf("SkippedPuts = %d, want 1", n)
+	}
+}
+
+func TestHTTPStorage(t *testing.T) {
+	for _, bazelRemote := range []bool{false, true} {
+		t.Run(fmt.Sprintf("bazelRemote=%v", bazelRemote), func(t *testing.T) {
+			srv := newFakeHTTPServer(t, true, bazelRemote, "")
+			h := NewHTTP(srv.URL+"/cache", HTTPOptions{BazelRemote: bazelRemote}, false)
+			if err := h.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			testStorage(t, h)
+		})
+	}
+}
+
+// Not found is a miss, any other status but success is an error.
+func TestHTTPStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status         int
+		getErr, putErr bool
+		miss, skipErr  bool
+	}{
+		{http.StatusOK, false, false, false, false},
+		{http.StatusCreated, true, false, false, true},
+		{http.StatusNoContent, true, false, false, true},
+		{http.StatusNotFound, false, true, true, false},
+		{http.StatusForbidden, true, true, false, true},
+		{http.StatusInternalServerError, true, true, false, true},
+	} {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(outputIDHeader, actionIDOf("o"))
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			h := NewHTTP(srv.URL, HTTPOptions{}, false)
+			ctx := context.Background()
+
+			outputID, _, _, body, err := h.Get(ctx, actionIDOf("a"))
+			if body != nil {
+				_ = body.Close()
+			}
+			if (err != nil) != tt.getErr || (err == nil && (outputID == "") != tt.miss) {
+				t.Errorf("Get = %q, %v; want error: %v, miss: %v", outputID, err, tt.getErr, tt.miss)
+			}
+			if err := h.Put(ctx, actionIDOf("a"), actionIDOf("o"), 1, bytesReader([]byte("x"))); (err != nil) != tt.putErr {
+				t.Errorf("Put error = %v, want error: %v", err, tt.putErr)
+			}
+			if _, err := h.SkipPut(ctx, actionIDOf("a"), actionIDOf("o"), 1); (err != nil) != tt.skipErr {
+				t.Errorf("SkipPut error = %v, want error: %v", err, tt.skipErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package remote
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+)
+
+// memoryEntry is an object held by Memory.
+type memoryEntry struct {
+	actionID string
+	outputID string
+	putTime  time.Time
+	body     []byte
+}
+
+var _ Storage = &Memory{}
+
+// Memory is a remote cache that keeps objects in memory, up to a total size,
+// evicting the least recently used ones. It is meant as the fastest tier of a
+// chain of caches.
+type Memory struct {
+	maxBytes int64
+	verbose  bool
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // of *memoryEntry, most recently used first
+	usedBytes int64
+	evictions int64
+	count.Count
+}
+
+// NewMemory creates a new Memory instance that holds up to maxBytes of objects.
+func NewMemory(maxBytes int64, verbose bool) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		verbose:  verbose,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (m *Memory) Kind() string {
+	return "memory"
+}
+
+func (m *Memory) Start(context.Context) error {
+	if m.verbose {
+		log.Printf("[%s] configured to hold %d bytes", m.Kind(), m.maxBytes)
+	}
+	return nil
+}
+
+func (m *Memory) Get(_ context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	m.Count.Gets.Add(1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[actionID]
+	if !ok {
+		m.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	m.lru.MoveToFront(elem)
+	e := elem.Value.(*memoryEntry)
+	return e.outputID, int64(len(e.body)), e.putTime, io.NopCloser(bytes.NewReader(e.body)), nil
+}
+
+func (m *Memory) Put(_ context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	m.Count.Puts.Add(1)
+	if size > m.maxBytes {
+		return nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(buf, body); err != nil {
+		m.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", m.Kind(), actionID, outputID, size, err)
+	}
+	if int64(buf.Len()) != size {
+		m.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s): read %d bytes, expected %d", m.Kind(), actionID, outputID, buf.Len(), size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[actionID]; ok {
+		m.remove(elem)
+	}
+	m.entries[actionID] = m.lru.PushFront(&memoryEntry{
+		actionID: actionID,
+		outputID: outputID,
+		putTime:  time.Now(),
+		body:     buf.Bytes(),
+	})
+	m.usedBytes += size
+	for m.usedBytes > m.maxBytes {
+		m.remove(m.lru.Back())
+		m.evictions++
+	}
+	return nil
+}
+
+func (m *Memory) remove(elem *list.Element) {
+	e := m.lru.Remove(elem).(*memoryEntry)
+	delete(m.entries, e.actionID)
+	m.usedBytes -= int64(len(e.body))
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) Summary() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Count.Summary(m.Kind()) + fmt.Sprintf("\n[%s] %d entries, %d bytes, %d evictions", m.Kind(), len(m.entries), m.usedBytes, m.evictions)
+}
@@ -0,0 +1,280 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ociremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types and annotations of the OCI artifacts that store the objects.
+const (
+	ociConfigMediaType    types.MediaType = "application/vnd.gocache.config.v1+json"
+	ociOutputMediaType    types.MediaType = "application/vnd.gocache.output.v1"
+	ociOutputIDAnnotation                 = "dev.gocache.outputid"
+	ociActionIDAnnotation                 = "dev.gocache.actionid"
+	ociCreatedAnnotation                  = "org.opencontainers.image.created"
+)
+
+// OCIOptions configures an OCI registry remote cache.
+type OCIOptions struct {
+	// Username and Password authenticate to the registry. If they are empty,
+	// the credentials come from the Docker config ($DOCKER_CONFIG) and its
+	// credential helpers.
+	Username string
+	Password string
+	// Insecure allows plain HTTP and unverified TLS connections to the registry.
+	Insecure bool
+}
+
+var _ Storage = &OCI{}
+
+// OCI is a remote cache that is backed by a repository of an OCI registry.
+// Each object is an artifact whose only layer is the body, tagged with the
+// digest of the bucket path and the ActionID, and annotated with its OutputID.
+type OCI struct {
+	repo       name.Repository
+	puller     *ociremote.Puller
+	pusher     *ociremote.Pusher
+	bucketPath string
+	verbose    bool
+	count.Count
+}
+
+// NewOCI creates a new OCI instance for the repository, e.g. ghcr.io/org/gocache.
+func NewOCI(repository string, cacheKey string, opts OCIOptions, verbose bool) (*OCI, error) {
+	var nameOpts []name.Option
+	if opts.Insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	repo, err := name.NewRepository(repository, nameOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI repository %q: %w", repository, err)
+	}
+
+	auth := ociremote.WithAuthFromKeychain(authn.DefaultKeychain)
+	if opts.Username != "" || opts.Password != "" {
+		auth = ociremote.WithAuth(&authn.Basic{Username: opts.Username, Password: opts.Password})
+	}
+	remoteOpts := []ociremote.Option{auth}
+	if opts.Insecure {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		remoteOpts = append(remoteOpts, ociremote.WithTransport(tr))
+	}
+	puller, err := ociremote.NewPuller(remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+	pusher, err := ociremote.NewPusher(remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketPath := BucketPath(cacheKey)
+
+	return &OCI{
+		repo:       repo,
+		puller:     puller,
+		pusher:     pusher,
+		bucketPath: bucketPath,
+		verbose:    verbose,
+	}, nil
+}
+
+// tag returns the tag of an action. Tags cannot hold the bucket path, so the
+// SHA-256 of the bucket path and the ActionID is used instead.
+func (o *OCI) tag(actionID string) name.Tag {
+	sum := sha256.Sum256([]byte(o.bucketPath + "/" + actionID))
+	return o.repo.Tag(hex.EncodeToString(sum[:]))
+}
+
+func (o *OCI) Kind() string {
+	return "oci"
+}
+
+func (o *OCI) Start(ctx context.Context) error {
+	if o.verbose {
+		log.Printf("[%s] start to %s (%s)", o.Kind(), o.repo, o.bucketPath)
+	}
+	return nil
+}
+
+func (o *OCI) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	o.Count.Gets.Add(1)
+	tag := o.tag(actionID)
+	desc, err := o.puller.Get(ctx, tag)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		o.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		o.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", o.Kind(), tag, err)
+	}
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		o.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (invalid manifest: %v)", o.Kind(), tag, err)
+	}
+	outputID := manifest.Annotations[ociOutputIDAnnotation]
+	if outputID == "" || len(manifest.Layers) != 1 {
+		o.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (not a cache artifact)", o.Kind(), tag)
+	}
+	putTime, _ := time.Parse(time.RFC3339Nano, manifest.Annotations[ociCreatedAnnotation])
+
+	output := manifest.Layers[0]
+	layer, err := o.puller.Layer(ctx, o.repo.Digest(output.Digest.String()))
+	if err != nil {
+		o.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", o.Kind(), tag, err)
+	}
+	body, err := layer.Compressed()
+	if err != nil {
+		o.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", o.Kind(), tag, err)
+	}
+	return outputID, output.Size, putTime, body, nil
+}
+
+func (o *OCI) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	o.Count.Puts.Add(1)
+	tag := o.tag(actionID)
+	if err := o.put(ctx, tag, actionID, outputID, size, body); err != nil {
+		o.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", o.Kind(), tag, outputID, size, err)
+	}
+	if o.verbose {
+		log.Printf("[%s] put success for %s (outputID: %s, size: %d)", o.Kind(), tag, outputID, size)
+	}
+	return nil
+}
+
+func (o *OCI) put(ctx context.Context, tag name.Tag, actionID, outputID string, size int64, body io.Reader) error {
+	// The OutputID is the SHA-256 of the body, so it is the digest of the
+	// blob; the registry rejects a body that does not match it. Bodies that
+	// cannot be read twice are spooled to a temporary file first, so that
+	// the upload can be retried.
+	digest, err := v1.NewHash("sha256:" + outputID)
+	if err != nil {
+		return fmt.Errorf("invalid outputID: %w", err)
+	}
+	ra, ok := body.(io.ReaderAt)
+	if !ok {
+		spooled, _, n, err := spool(body)
+		if err != nil {
+			return err
+		}
+		defer spooled.Close()
+		if n != size {
+			return fmt.Errorf("body is %d bytes, expected %d", n, size)
+		}
+		ra = spooled.(io.ReaderAt)
+	}
+	output := &ociBlob{r: ra, digest: digest, size: size, mediaType: ociOutputMediaType}
+	config := static.NewLayer([]byte("{}"), ociConfigMediaType)
+	configDigest, err := config.Digest()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range []v1.Layer{config, output} {
+		if err := o.pusher.Upload(ctx, o.repo, l); err != nil {
+			return err
+		}
+	}
+	manifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: ociConfigMediaType,
+			Size:      2,
+			Digest:    configDigest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: ociOutputMediaType,
+			Size:      size,
+			Digest:    digest,
+		}},
+		Annotations: map[string]string{
+			ociOutputIDAnnotation: outputID,
+			ociActionIDAnnotation: actionID,
+			ociCreatedAnnotation:  time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return o.pusher.Put(ctx, tag, ociManifest(manifest))
+}
+
+func (o *OCI) Close() error {
+	return nil
+}
+
+func (o *OCI) Summary() string {
+	return o.Count.Summary(o.Kind())
+}
+
+// ociManifest is a raw OCI image manifest that can be pushed to a tag.
+type ociManifest []byte
+
+func (m ociManifest) RawManifest() ([]byte, error) {
+	return m, nil
+}
+
+func (m ociManifest) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+// ociBlob is a layer whose content is read as is from r.
+type ociBlob struct {
+	r         io.ReaderAt
+	digest    v1.Hash
+	size      int64
+	mediaType types.MediaType
+}
+
+func (b *ociBlob) Digest() (v1.Hash, error) {
+	return b.digest, nil
+}
+
+func (b *ociBlob) DiffID() (v1.Hash, error) {
+	return b.digest, nil
+}
+
+func (b *ociBlob) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(io.NewSectionReader(b.r, 0, b.size)), nil
+}
+
+func (b *ociBlob) Uncompressed() (io.ReadCloser, error) {
+	return b.Compressed()
+}
+
+func (b *ociBlob) Size() (int64, error) {
+	return b.size, nil
+}
+
+func (b *ociBlob) MediaType() (types.MediaType, error) {
+	return b.mediaType, nil
+}
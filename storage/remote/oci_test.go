@@ -0,0 +1,157 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+// newTestRegistry is an in-memory OCI registry that does not log its requests.
+func newTestRegistry() http.Handler {
+	return registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+}
+
+func newTestOCI(t *testing.T, handler http.Handler, opts OCIOptions) *OCI {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	opts.Insecure = true
+	o, err := NewOCI(strings.TrimPrefix(srv.URL, "http://")+"/gocache", "v1", opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOCIPutGet(t *testing.T) {
+	o := newTestOCI(t, newTestRegistry(), OCIOptions{})
+	ctx := context.Background()
+	for _, data := range [][]byte{[]byte("hello, world"), nil} {
+		actionID := actionIDOf(string(data))
+		sum := sha256.Sum256(data)
+		outputID := hex.EncodeToString(sum[:])
+		// Streamed bodies are spooled, so that the upload can be retried.
+		for _, body := range []io.Reader{bytes.NewReader(data), bytesReader(data)} {
+			if err := o.Put(ctx, actionID, outputID, int64(len(data)), body); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		gotOutputID, size, putTime, body, err := o.Get(ctx, actionID)
+		if err != nil || body == nil {
+			t.Fatalf("Get = %v, %v; want a hit", body, err)
+		}
+		got, _ := io.ReadAll(body)
+		_ = body.Close()
+		if gotOutputID != outputID || size != int64(len(data)) || !bytes.Equal(got, data) {
+			t.Errorf("Get = %s, %d, %q; want %s, %d, %q", gotOutputID, size, got, outputID, len(data), data)
+		}
+		if putTime.IsZero() {
+			t.Errorf("Get: no put time")
+		}
+	}
+}
+
+func TestOCIMiss(t *testing.T) {
+	o := newTestOCI(t, newTestRegistry(), OCIOptions{})
+	outputID, _, _, body, err := o.Get(context.Background(), actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if o.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", o.Count.Misses.Load())
+	}
+}
+
+// Actions are tagged by bucket path, so other cache keys do not see them.
+func TestOCIBucketPath(t *testing.T) {
+	o := newTestOCI(t, newTestRegistry(), OCIOptions{})
+	ctx := context.Background()
+	if err := o.Put(ctx, actionIDOf("a"), actionIDOf(""), 0, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	other, err := NewOCI(o.repo.String(), "v2", OCIOptions{Insecure: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, body, err := other.Get(ctx, actionIDOf("a")); err != nil || body != nil {
+		t.Errorf("Get with another cache key = %v, %v; want a miss", body, err)
+	}
+}
+
+func TestOCIBasicAuth(t *testing.T) {
+	reg := newTestRegistry()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	})
+	ctx := context.Background()
+
+	o := newTestOCI(t, handler, OCIOptions{Username: "user", Password: "secret"})
+	if err := o.Put(ctx, actionIDOf("a"), actionIDOf(""), 0, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, _, body, err := o.Get(ctx, actionIDOf("a")); err != nil || body == nil {
+		t.Errorf("Get = %v, %v; want a hit", body, err)
+	}
+
+	wrong, err := NewOCI(o.repo.String(), "v1", OCIOptions{Username: "user", Password: "wrong", Insecure: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := wrong.Get(ctx, actionIDOf("a")); err == nil {
+		t.Errorf("Get with a wrong password succeeded")
+	}
+}
+
+func TestOCIStorage(t *testing.T) {
+	testStorage(t, newTestOCI(t, newTestRegistry(), OCIOptions{}))
+}
+
+// The blob of an output is addressed by its OutputID, so the registry rejects
+// a body that does not match it.
+func TestOCIDigest(t *testing.T) {
+	o := newTestOCI(t, newTestRegistry(), OCIOptions{})
+	ctx := context.Background()
+	data := []byte("hello, world")
+	if err := o.Put(ctx, actionIDOf("a"), actionIDOf("other"), int64(len(data)), bytes.NewReader(data)); err == nil {
+		t.Errorf("Put of a body that does not match its OutputID succeeded")
+	}
+	if _, _, _, body, err := o.Get(ctx, actionIDOf("a")); err != nil || body != nil {
+		t.Errorf("Get after a rejected put = %v, %v; want a miss", body, err)
+	}
+	if err := o.Put(ctx, actionIDOf("a"), "not-hex", int64(len(data)), bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "invalid outputID") {
+		t.Errorf("Put with an invalid OutputID = %v, want an error", err)
+	}
+	if o.Count.PutErrors.Load() != 2 {
+		t.Errorf("PutErrors = %d, want 2", o.Count.PutErrors.Load())
+	}
+
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := o.Put(ctx, actionIDOf("a"), outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	layer, err := o.puller.Layer(ctx, o.repo.Digest("sha256:"+outputID))
+	if err != nil {
+		t.Fatalf("no blob for the OutputID: %v", err)
+	}
+	if size, err := layer.Size(); err != nil || size != int64(len(data)) {
+		t.Errorf("blob size = %d, %v; want %d", size, err, len(data))
+	}
+}
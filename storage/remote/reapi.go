@@ -0,0 +1,410 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// reapiOutputFile is the path of the output file in the ActionResult of an action.
+	reapiOutputFile = "output"
+	// reapiOutputIDProperty is the node property of the output file that holds the OutputID.
+	reapiOutputIDProperty = "gocache.outputid"
+	// reapiMaxBatchSize is the size up to which blobs are uploaded with
+	// BatchUpdateBlobs rather than ByteStream, below the usual 4MiB gRPC limit.
+	reapiMaxBatchSize = 2 << 20
+	// reapiChunkSize is the size of the ByteStream write requests.
+	reapiChunkSize = 1 << 20
+)
+
+// REAPIOptions configures the connection to a Remote Execution API cache.
+type REAPIOptions struct {
+	// InstanceName is the instance name sent with every request.
+	InstanceName string
+	// TLS enables TLS, with the system roots unless CAFile is set.
+	TLS bool
+	// CAFile is a PEM file of the certificate authorities that sign the server certificate.
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// Header is sent as gRPC metadata with every request, e.g. for authorization.
+	Header map[string]string
+}
+
+// NewREAPIConn connects to the Remote Execution API server at target.
+func NewREAPIConn(target string, opts REAPIOptions) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if opts.TLS {
+		tlsConfig := &tls.Config{}
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+			}
+		}
+		if opts.CertFile != "" || opts.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if len(opts.Header) > 0 {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(headerCredentials(opts.Header)))
+	}
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Remote Execution API client: %w", err)
+	}
+	return conn, nil
+}
+
+// headerCredentials sends fixed metadata with every request.
+type headerCredentials map[string]string
+
+func (h headerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return h, nil
+}
+
+func (h headerCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+var _ Storage = &REAPI{}
+
+// REAPI is a remote cache that is backed by the ContentAddressableStorage and
+// ActionCache services of the Remote Execution API, as implemented by
+// bazel-remote, BuildBuddy or Buildbarn.
+//
+// The body of an object is stored in the CAS. Each action is stored in the
+// action cache under the digest of its bucket path, as an ActionResult with a
+// single output file that references the body and carries the OutputID as a
+// node property.
+type REAPI struct {
+	conn       grpc.ClientConnInterface
+	cas        repb.ContentAddressableStorageClient
+	ac         repb.ActionCacheClient
+	bs         bspb.ByteStreamClient
+	target     string
+	bucketPath string
+	opts       REAPIOptions
+	verbose    bool
+	count.Count
+}
+
+// NewREAPI creates a new REAPI instance that sends its requests over conn.
+func NewREAPI(conn grpc.ClientConnInterface, target, cacheKey string, opts REAPIOptions, verbose bool) *REAPI {
+	bucketPath := BucketPath(cacheKey)
+
+	return &REAPI{
+		conn:       conn,
+		cas:        repb.NewContentAddressableStorageClient(conn),
+		ac:         repb.NewActionCacheClient(conn),
+		bs:         bspb.NewByteStreamClient(conn),
+		target:     target,
+		bucketPath: bucketPath,
+		opts:       opts,
+		verbose:    verbose,
+	}
+}
+
+// actionDigest is the action cache key of actionID.
+func (r *REAPI) actionDigest(actionID string) *repb.Digest {
+	key := fmt.Sprintf("%s/%s", r.bucketPath, actionID)
+	sum := sha256.Sum256([]byte(key))
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(key))}
+}
+
+func (r *REAPI) blobResourceName(d *repb.Digest) string {
+	return path.Join(r.opts.InstanceName, "blobs", d.Hash, fmt.Sprint(d.SizeBytes))
+}
+
+func (r *REAPI) Kind() string {
+	return "reapi"
+}
+
+func (r *REAPI) Start(context.Context) error {
+	if r.verbose {
+		log.Printf("[%s] configured to %s (instance: %q, path: %s)", r.Kind(), r.target, r.opts.InstanceName, r.bucketPath)
+	}
+	return nil
+}
+
+func (r *REAPI) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	r.Count.Gets.Add(1)
+	result, err := r.ac.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName:   r.opts.InstanceName,
+		ActionDigest:   r.actionDigest(actionID),
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	if status.Code(err) == codes.NotFound {
+		r.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		r.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", r.Kind(), actionID, err)
+	}
+
+	outputID, digest, putTime, err := parseActionResult(result)
+	if err != nil {
+		r.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", r.Kind(), actionID, err)
+	}
+
+	body, err := r.read(ctx, digest)
+	if status.Code(err) == codes.NotFound {
+		// The CAS evicted the output, but not yet the action result.
+		r.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		r.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (failed to read blob %s): %w", r.Kind(), actionID, digest.GetHash(), err)
+	}
+	return outputID, digest.GetSizeBytes(), putTime, body, nil
+}
+
+// newActionResult is the ActionResult of an action whose output is stored in
+// the CAS under digest.
+func newActionResult(outputID string, digest *repb.Digest) *repb.ActionResult {
+	return &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{{
+			Path:   reapiOutputFile,
+			Digest: digest,
+			NodeProperties: &repb.NodeProperties{
+				Properties: []*repb.NodeProperty{{Name: reapiOutputIDProperty, Value: outputID}},
+			},
+		}},
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			OutputUploadCompletedTimestamp: timestamppb.Now(),
+		},
+	}
+}
+
+// parseActionResult returns the OutputID, the CAS digest of the output and
+// the put time of an ActionResult written by newActionResult.
+func parseActionResult(result *repb.ActionResult) (string, *repb.Digest, time.Time, error) {
+	var file *repb.OutputFile
+	for _, f := range result.GetOutputFiles() {
+		if f.GetPath() == reapiOutputFile {
+			file = f
+		}
+	}
+	if file == nil || file.GetDigest() == nil {
+		return "", nil, time.Time{}, errors.New("no output file in action result")
+	}
+	outputID := file.GetDigest().GetHash()
+	for _, p := range file.GetNodeProperties().GetProperties() {
+		if p.GetName() == reapiOutputIDProperty {
+			outputID = p.GetValue()
+		}
+	}
+	var putTime time.Time
+	if ts := result.GetExecutionMetadata().GetOutputUploadCompletedTimestamp(); ts != nil {
+		putTime = ts.AsTime()
+	}
+	return outputID, file.GetDigest(), putTime, nil
+}
+
+// read streams a blob from the CAS. The first response is awaited, so that a
+// blob missing from the CAS is reported by read rather than by the reader.
+func (r *REAPI) read(ctx context.Context, d *repb.Digest) (io.ReadCloser, error) {
+	if d.GetSizeBytes() == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := r.bs.Read(ctx, &bspb.ReadRequest{ResourceName: r.blobResourceName(d)})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		cancel()
+		return nil, err
+	}
+	return &byteStreamReader{stream: stream, cancel: cancel, buf: res.GetData()}, nil
+}
+
+func (r *REAPI) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	r.Count.Puts.Add(1)
+	if err := r.put(ctx, actionID, outputID, size, body); err != nil {
+		r.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", r.Kind(), actionID, outputID, size, err)
+	}
+	if r.verbose {
+		log.Printf("[%s] put success for %s (outputID: %s, size: %d)", r.Kind(), actionID, outputID, size)
+	}
+	return nil
+}
+
+// put stores the body in the CAS under the OutputID, which is the SHA-256 of
+// the body, and then the action result that references it.
+func (r *REAPI) put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	digest := &repb.Digest{Hash: outputID, SizeBytes: size}
+
+	if size > 0 {
+		missing, err := r.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+			InstanceName:   r.opts.InstanceName,
+			BlobDigests:    []*repb.Digest{digest},
+			DigestFunction: repb.DigestFunction_SHA256,
+		})
+		if err != nil {
+			return err
+		}
+		if len(missing.GetMissingBlobDigests()) > 0 {
+			if err := r.write(ctx, digest, body); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := r.ac.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName:   r.opts.InstanceName,
+		ActionDigest:   r.actionDigest(actionID),
+		ActionResult:   newActionResult(outputID, digest),
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	return err
+}
+
+// write uploads a blob to the CAS, in a single batch request if it is small
+// enough and with ByteStream otherwise.
+func (r *REAPI) write(ctx context.Context, d *repb.Digest, body io.Reader) error {
+	if d.GetSizeBytes() <= reapiMaxBatchSize {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != d.GetSizeBytes() {
+			return fmt.Errorf("body is %d bytes", len(data))
+		}
+		res, err := r.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+			InstanceName:   r.opts.InstanceName,
+			Requests:       []*repb.BatchUpdateBlobsRequest_Request{{Digest: d, Data: data}},
+			DigestFunction: repb.DigestFunction_SHA256,
+		})
+		if err != nil {
+			return err
+		}
+		for _, resp := range res.GetResponses() {
+			if err := status.FromProto(resp.GetStatus()).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	uuid := make([]byte, 16)
+	_, _ = rand.Read(uuid)
+	resourceName := path.Join(r.opts.InstanceName, "uploads", hex.EncodeToString(uuid), "blobs", d.Hash, fmt.Sprint(d.SizeBytes))
+	stream, err := r.bs.Write(ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, reapiChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		last := offset+int64(n) >= d.SizeBytes
+		req := &bspb.WriteRequest{WriteOffset: offset, Data: buf[:n], FinishWrite: last}
+		if offset == 0 {
+			req.ResourceName = resourceName
+		}
+		if err := stream.Send(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				// The server already has the blob and ended the stream early.
+				break
+			}
+			return err
+		}
+		offset += int64(n)
+		if last {
+			break
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if res.GetCommittedSize() != d.SizeBytes && res.GetCommittedSize() != -1 {
+		return fmt.Errorf("committed %d bytes, expected %d", res.GetCommittedSize(), d.SizeBytes)
+	}
+	return nil
+}
+
+func (r *REAPI) Close() error {
+	if c, ok := r.conn.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("[%s] close %s (error: %v)", r.Kind(), r.target, err)
+		}
+	}
+	return nil
+}
+
+func (r *REAPI) Summary() string {
+	return r.Count.Summary(r.Kind())
+}
+
+// byteStreamReader reads the responses of a ByteStream Read.
+type byteStreamReader struct {
+	stream bspb.ByteStream_ReadClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (b *byteStreamReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		res, err := b.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		b.buf = res.GetData()
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *byteStreamReader) Close() error {
+	b.cancel()
+	return nil
+}
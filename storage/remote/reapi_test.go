@@ -0,0 +1,305 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeREAPIServer is an in-memory ActionCache, CAS and ByteStream server that
+// checks blobs against their digest, like a real Remote Execution API cache.
+type fakeREAPIServer struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bspb.UnimplementedByteStreamServer
+
+	mu      sync.Mutex
+	actions map[string]*repb.ActionResult
+	blobs   map[string][]byte
+	writes  int // ByteStream writes
+	batches int // BatchUpdateBlobs requests
+}
+
+func newFakeREAPI(t *testing.T) (*fakeREAPIServer, *REAPI) {
+	t.Helper()
+	f := &fakeREAPIServer{actions: map[string]*repb.ActionResult{}, blobs: map[string][]byte{}}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	repb.RegisterActionCacheServer(srv, f)
+	repb.RegisterContentAddressableStorageServer(srv, f)
+	bspb.RegisterByteStreamServer(srv, f)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewREAPI(conn, "bufconn", "v1", REAPIOptions{InstanceName: "main"}, false)
+	t.Cleanup(func() { _ = r.Close() })
+	return f, r
+}
+
+func (f *fakeREAPIServer) GetActionResult(_ context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result, ok := f.actions[req.GetActionDigest().GetHash()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "action not found")
+	}
+	return result, nil
+}
+
+func (f *fakeREAPIServer) UpdateActionResult(_ context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, file := range req.GetActionResult().GetOutputFiles() {
+		if d := file.GetDigest(); d.GetSizeBytes() > 0 && f.blobs[d.GetHash()] == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "missing blob %s", d.GetHash())
+		}
+	}
+	f.actions[req.GetActionDigest().GetHash()] = proto.Clone(req.GetActionResult()).(*repb.ActionResult)
+	return req.GetActionResult(), nil
+}
+
+func (f *fakeREAPIServer) FindMissingBlobs(_ context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := &repb.FindMissingBlobsResponse{}
+	for _, d := range req.GetBlobDigests() {
+		if f.blobs[d.GetHash()] == nil {
+			res.MissingBlobDigests = append(res.MissingBlobDigests, d)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeREAPIServer) BatchUpdateBlobs(_ context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches++
+	res := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.GetRequests() {
+		st := status.New(codes.OK, "")
+		if err := f.store(r.GetDigest(), r.GetData()); err != nil {
+			st = status.Convert(err)
+		}
+		res.Responses = append(res.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: r.GetDigest(), Status: st.Proto()})
+	}
+	return res, nil
+}
+
+// store checks data against its digest and stores it. f.mu must be held.
+func (f *fakeREAPIServer) store(d *repb.Digest, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != d.GetHash() || int64(len(data)) != d.GetSizeBytes() {
+		return status.Errorf(codes.InvalidArgument, "blob does not match its digest %s/%d", d.GetHash(), d.GetSizeBytes())
+	}
+	f.blobs[d.GetHash()] = data
+	return nil
+}
+
+// parseResourceName returns the digest of a [<instance>/][uploads/<uuid>/]blobs/<hash>/<size> resource name.
+func parseResourceName(name string) (*repb.Digest, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid resource name %s", name)
+	}
+	size, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid resource name %s", name)
+	}
+	return &repb.Digest{Hash: parts[len(parts)-2], SizeBytes: size}, nil
+}
+
+func (f *fakeREAPIServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	d, err := parseResourceName(req.GetResourceName())
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	data, ok := f.blobs[d.GetHash()]
+	f.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "blob %s not found", d.GetHash())
+	}
+	// Send small chunks to exercise the reassembly of the client.
+	for len(data) > 0 {
+		n := min(len(data), 64<<10)
+		if err := stream.Send(&bspb.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (f *fakeREAPIServer) Write(stream bspb.ByteStream_WriteServer) error {
+	var d *repb.Digest
+	var buf bytes.Buffer
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			if d, err = parseResourceName(req.GetResourceName()); err != nil {
+				return err
+			}
+		}
+		if req.GetWriteOffset() != int64(buf.Len()) {
+			return status.Errorf(codes.InvalidArgument, "write at offset %d, expected %d", req.GetWriteOffset(), buf.Len())
+		}
+		buf.Write(req.GetData())
+		if req.GetFinishWrite() {
+			break
+		}
+	}
+	f.mu.Lock()
+	f.writes++
+	err := f.store(d, buf.Bytes())
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+func reapiPutGet(t *testing.T, r *REAPI, actionID string, data []byte) {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := r.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	gotOutputID, size, putTime, body, err := r.Get(ctx, actionID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if body == nil {
+		t.Fatalf("Get: miss after Put")
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if gotOutputID != outputID || size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Errorf("Get = %s, %d, %d bytes; want %s, %d, %d bytes", gotOutputID, size, len(got), outputID, len(data), len(data))
+	}
+	if putTime.IsZero() {
+		t.Errorf("Get: no put time")
+	}
+}
+
+func TestREAPIPutGet(t *testing.T) {
+	f, r := newFakeREAPI(t)
+	reapiPutGet(t, r, actionIDOf("small"), []byte("hello, world"))
+	reapiPutGet(t, r, actionIDOf("empty"), nil)
+	if f.batches != 1 || f.writes != 0 {
+		t.Errorf("small blob: %d batches, %d writes; want a single batch", f.batches, f.writes)
+	}
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), (reapiMaxBatchSize+reapiChunkSize)/16+1)
+	reapiPutGet(t, r, actionIDOf("large"), large)
+	if f.writes != 1 {
+		t.Errorf("large blob: %d writes, want 1", f.writes)
+	}
+
+	// The same output is not uploaded again for another action.
+	reapiPutGet(t, r, actionIDOf("large again"), large)
+	if f.writes != 1 {
+		t.Errorf("existing blob: %d writes, want 1", f.writes)
+	}
+}
+
+func TestREAPIMiss(t *testing.T) {
+	_, r := newFakeREAPI(t)
+	outputID, _, _, body, err := r.Get(context.Background(), actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if r.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", r.Count.Misses.Load())
+	}
+}
+
+func TestREAPIPutShortBody(t *testing.T) {
+	_, r := newFakeREAPI(t)
+	data := []byte("hello, world")
+	sum := sha256.Sum256(data)
+	err := r.Put(context.Background(), actionIDOf("a"), hex.EncodeToString(sum[:]), int64(len(data)), bytes.NewReader(data[:4]))
+	if err == nil {
+		t.Errorf("Put of a short body succeeded")
+	}
+	if r.Count.PutErrors.Load() != 1 {
+		t.Errorf("PutErrors = %d, want 1", r.Count.PutErrors.Load())
+	}
+}
+
+// The action cache is keyed by the bucket path, so that different Go versions
+// and cache keys do not share entries.
+func TestREAPIBucketPath(t *testing.T) {
+	f, r := newFakeREAPI(t)
+	reapiPutGet(t, r, actionIDOf("a"), []byte("data"))
+	other := NewREAPI(r.conn, "bufconn", "v2", r.opts, false)
+	outputID, _, _, body, err := other.Get(context.Background(), actionIDOf("a"))
+	if err != nil || body != nil {
+		t.Errorf("Get with another cache key = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if len(f.actions) != 1 {
+		t.Errorf("%d actions stored, want 1", len(f.actions))
+	}
+}
+
+func TestREAPIStorage(t *testing.T) {
+	_, r := newFakeREAPI(t)
+	testStorage(t, r)
+}
+
+// An action result whose output was evicted from the CAS is a miss.
+func TestREAPIMissingBlob(t *testing.T) {
+	f, r := newFakeREAPI(t)
+	data := []byte("evicted")
+	reapiPutGet(t, r, actionIDOf("a"), data)
+	sum := sha256.Sum256(data)
+	f.mu.Lock()
+	delete(f.blobs, hex.EncodeToString(sum[:]))
+	f.mu.Unlock()
+
+	outputID, _, _, body, err := r.Get(context.Background(), actionIDOf("a"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if r.Count.Misses.Load() != 1 || r.Count.GetErrors.Load() != 0 {
+		t.Errorf("misses = %d, errors = %d; want 1, 0", r.Count.Misses.Load(), r.Count.GetErrors.Load())
+	}
+}
+
+// An action result that was not written by gocache is an error, not a hit.
+func TestREAPIForeignActionResult(t *testing.T) {
+	f, r := newFakeREAPI(t)
+	f.actions[r.actionDigest(actionIDOf("a")).GetHash()] = &repb.ActionResult{ExitCode: 1}
+	if outputID, _, _, body, err := r.Get(context.Background(), actionIDOf("a")); err == nil || body != nil {
+		t.Errorf("Get = %q, %v, %v; want an error", outputID, body, err)
+	}
+}
@@ -0,0 +1,206 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Fields of the Redis hash that stores an object.
+const (
+	redisOutputIDField = "outputid"
+	redisTimeField     = "time"
+	redisBodyField     = "body"
+)
+
+// RedisOptions configures a Redis remote cache.
+type RedisOptions struct {
+	// TTL is how long objects are kept after they are put, zero to keep them forever.
+	TTL time.Duration
+	// MaxObjectSize is the size above which objects are not stored, zero for no limit.
+	MaxObjectSize int64
+	// TLS enables TLS even if the URL does not use the rediss scheme.
+	TLS bool
+}
+
+// NewRedisClient creates a client for the Redis or Valkey server at url, in
+// the form redis://[[user]:password@]host[:port][/db]. The rediss scheme
+// enables TLS.
+func NewRedisClient(url string, opts RedisOptions) (*redis.Client, error) {
+	redisOpts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	if opts.TLS && redisOpts.TLSConfig == nil {
+		redisOpts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return redis.NewClient(redisOpts), nil
+}
+
+var (
+	_ Storage    = &Redis{}
+	_ PutSkipper = &Redis{}
+)
+
+// Redis is a remote cache that is backed by a Redis or Valkey server. Each
+// object is a hash of its OutputID, put time and body, under the bucket path
+// of its action.
+type Redis struct {
+	client     redis.UniversalClient
+	bucketPath string
+	opts       RedisOptions
+	verbose    bool
+	skipped    atomic.Int64
+	count.Count
+}
+
+// NewRedis creates a new Redis instance.
+func NewRedis(client redis.UniversalClient, cacheKey string, opts RedisOptions, verbose bool) *Redis {
+	bucketPath := BucketPath(cacheKey)
+
+	return &Redis{
+		client:     client,
+		bucketPath: bucketPath,
+		opts:       opts,
+		verbose:    verbose,
+	}
+}
+
+func (r *Redis) key(actionID string) string {
+	return fmt.Sprintf("%s/%s", r.bucketPath, actionID)
+}
+
+func (r *Redis) Kind() string {
+	return "redis"
+}
+
+func (r *Redis) Start(ctx context.Context) error {
+	if r.verbose {
+		log.Printf("[%s] start to %s", r.Kind(), r.bucketPath)
+	}
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("[%s] failed to start %s: %w", r.Kind(), r.bucketPath, err)
+	}
+	return nil
+}
+
+func (r *Redis) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	r.Count.Gets.Add(1)
+	key := r.key(actionID)
+	values, err := r.client.HMGet(ctx, key, redisOutputIDField, redisTimeField, redisBodyField).Result()
+	if err != nil {
+		r.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", r.Kind(), key, err)
+	}
+	outputID, _ := values[0].(string)
+	body, ok := values[2].(string)
+	if outputID == "" || !ok {
+		r.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	var putTime time.Time
+	if s, ok := values[1].(string); ok {
+		if nanos, err := strconv.ParseInt(s, 10, 64); err == nil {
+			putTime = time.Unix(0, nanos)
+		}
+	}
+	return outputID, int64(len(body)), putTime, io.NopCloser(bytes.NewReader([]byte(body))), nil
+}
+
+func (r *Redis) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	key := r.key(actionID)
+	if r.opts.MaxObjectSize > 0 && size > r.opts.MaxObjectSize {
+		r.skipped.Add(1)
+		if r.verbose {
+			log.Printf("[%s] put skipped for %s (size %d above %d)", r.Kind(), key, size, r.opts.MaxObjectSize)
+		}
+		return nil
+	}
+	r.Count.Puts.Add(1)
+	data, err := io.ReadAll(body)
+	if err == nil && int64(len(data)) != size {
+		err = fmt.Errorf("body is %d bytes", len(data))
+	}
+	if err != nil {
+		r.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", r.Kind(), key, outputID, size, err)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			redisOutputIDField, outputID,
+			redisTimeField, strconv.FormatInt(time.Now().UnixNano(), 10),
+			redisBodyField, data,
+		)
+		if r.opts.TTL > 0 {
+			pipe.Expire(ctx, key, r.opts.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		r.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", r.Kind(), key, outputID, size, err)
+	}
+	if r.verbose {
+		log.Printf("[%s] put success for %s (outputID: %s, size: %d)", r.Kind(), key, outputID, size)
+	}
+	return nil
+}
+
+// SkipPut reports whether the server already stores outputID for actionID.
+// The TTL of the object is renewed, as a put would do.
+func (r *Redis) SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error) {
+	if r.opts.MaxObjectSize > 0 && size > r.opts.MaxObjectSize {
+		return false, nil
+	}
+	key := r.key(actionID)
+	var storedOutputID *redis.StringCmd
+	var storedSize *redis.Cmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		storedOutputID = pipe.HGet(ctx, key, redisOutputIDField)
+		storedSize = pipe.Do(ctx, "HSTRLEN", key, redisBodyField)
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("[%s] head %s (%v)", r.Kind(), key, err)
+	}
+	if n, _ := storedSize.Int64(); storedOutputID.Val() != outputID || n != size {
+		return false, nil
+	}
+	if r.opts.TTL > 0 {
+		if err := r.client.Expire(ctx, key, r.opts.TTL).Err(); err != nil {
+			return false, fmt.Errorf("[%s] expire %s (%v)", r.Kind(), key, err)
+		}
+	}
+	r.Count.SkippedPuts.Add(1)
+	return true, nil
+}
+
+func (r *Redis) Close() error {
+	if err := r.client.Close(); err != nil && !errors.Is(err, redis.ErrClosed) {
+		return fmt.Errorf("[%s] close %s (error: %v)", r.Kind(), r.bucketPath, err)
+	}
+	return nil
+}
+
+func (r *Redis) Summary() string {
+	summary := r.Count.Summary(r.Kind())
+	if skipped := r.skipped.Load(); skipped > 0 {
+		summary += fmt.Sprintf("\n[%s] %d puts skipped above max object size", r.Kind(), skipped)
+	}
+	return summary
+}
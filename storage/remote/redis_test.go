@@ -0,0 +1,174 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T, opts RedisOptions) (*miniredis.Miniredis, *Redis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client, err := NewRedisClient("redis://"+mr.Addr(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRedis(client, "v1", opts, false)
+	t.Cleanup(func() { _ = r.Close() })
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return mr, r
+}
+
+func redisPut(t *testing.T, r *Redis, actionID string, data []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := r.Put(context.Background(), actionID, outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return outputID
+}
+
+func TestRedisPutGet(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{})
+	for _, data := range [][]byte{[]byte("hello, world"), nil} {
+		actionID := actionIDOf(string(data))
+		before := time.Now()
+		outputID := redisPut(t, r, actionID, data)
+		gotOutputID, size, putTime, body, err := r.Get(context.Background(), actionID)
+		if err != nil || body == nil {
+			t.Fatalf("Get = %v, %v; want a hit", body, err)
+		}
+		got, _ := io.ReadAll(body)
+		if gotOutputID != outputID || size != int64(len(data)) || !bytes.Equal(got, data) {
+			t.Errorf("Get = %s, %d, %q; want %s, %d, %q", gotOutputID, size, got, outputID, len(data), data)
+		}
+		if putTime.Before(before.Truncate(time.Second)) {
+			t.Errorf("put time %v is before the put at %v", putTime, before)
+		}
+		if !mr.Exists(r.key(actionID)) {
+			t.Errorf("no hash at %s", r.key(actionID))
+		}
+	}
+}
+
+func TestRedisMiss(t *testing.T) {
+	_, r := newTestRedis(t, RedisOptions{})
+	outputID, _, _, body, err := r.Get(context.Background(), actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get = %q, %v, %v; want a miss", outputID, body, err)
+	}
+	if r.Count.Misses.Load() != 1 {
+		t.Errorf("Misses = %d, want 1", r.Count.Misses.Load())
+	}
+}
+
+func TestRedisTTL(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{TTL: time.Hour})
+	actionID := actionIDOf("a")
+	outputID := redisPut(t, r, actionID, []byte("data"))
+	if ttl := mr.TTL(r.key(actionID)); ttl != time.Hour {
+		t.Errorf("TTL = %v, want 1h", ttl)
+	}
+
+	// SkipPut renews the TTL like the put that it skips.
+	mr.FastForward(30 * time.Minute)
+	if skip, err := r.SkipPut(context.Background(), actionID, outputID, 4); err != nil || !skip {
+		t.Errorf("SkipPut = %v, %v; want true", skip, err)
+	}
+	if ttl := mr.TTL(r.key(actionID)); ttl != time.Hour {
+		t.Errorf("TTL after SkipPut = %v, want 1h", ttl)
+	}
+
+	mr.FastForward(2 * time.Hour)
+	if _, _, _, body, err := r.Get(context.Background(), actionID); err != nil || body != nil {
+		t.Errorf("Get after the TTL = %v, %v; want a miss", body, err)
+	}
+}
+
+func TestRedisSkipPut(t *testing.T) {
+	_, r := newTestRedis(t, RedisOptions{})
+	ctx := context.Background()
+	actionID := actionIDOf("a")
+	if skip, err := r.SkipPut(ctx, actionID, actionIDOf("o"), 4); err != nil || skip {
+		t.Fatalf("SkipPut before Put = %v, %v; want false", skip, err)
+	}
+	outputID := redisPut(t, r, actionID, []byte("data"))
+	if skip, _ := r.SkipPut(ctx, actionID, outputID, 5); skip {
+		t.Errorf("SkipPut of another size = true, want false")
+	}
+	if skip, _ := r.SkipPut(ctx, actionID, actionIDOf("o"), 4); skip {
+		t.Errorf("SkipPut of another output = true, want false")
+	}
+	if skip, err := r.SkipPut(ctx, actionID, outputID, 4); err != nil || !skip {
+		t.Errorf("SkipPut = %v, %v; want true", skip, err)
+	}
+}
+
+func TestRedisMaxObjectSize(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{MaxObjectSize: 4})
+	if strings.Contains(r.Summary(), "above max object size") {
+		t.Errorf("Summary reports skipped puts before any: %q", r.Summary())
+	}
+	redisPut(t, r, actionIDOf("small"), []byte("data"))
+	redisPut(t, r, actionIDOf("large"), []byte("too large"))
+	if mr.Exists(r.key(actionIDOf("large"))) {
+		t.Errorf("object above the max size was stored")
+	}
+	if !strings.Contains(r.Summary(), "1 puts skipped above max object size") {
+		t.Errorf("Summary = %q, want 1 put skipped", r.Summary())
+	}
+}
+
+func TestRedisGetError(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{})
+	mr.SetError("unavailable")
+	if _, _, _, _, err := r.Get(context.Background(), actionIDOf("a")); err == nil {
+		t.Errorf("Get succeeded on a failing server")
+	}
+	if r.Count.GetErrors.Load() != 1 {
+		t.Errorf("GetErrors = %d, want 1", r.Count.GetErrors.Load())
+	}
+}
+
+func TestRedisStorage(t *testing.T) {
+	_, r := newTestRedis(t, RedisOptions{TTL: time.Hour})
+	testStorage(t, r)
+}
+
+// A hash without both the OutputID and the body, e.g. written by hand, is a
+// miss.
+func TestRedisPartialHash(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{})
+	mr.HSet(r.key(actionIDOf("no body")), redisOutputIDField, actionIDOf("o"))
+	mr.HSet(r.key(actionIDOf("no output")), redisBodyField, "data")
+	for _, name := range []string{"no body", "no output"} {
+		if outputID, _, _, body, err := r.Get(context.Background(), actionIDOf(name)); err != nil || body != nil {
+			t.Errorf("Get of %s = %q, %v, %v; want a miss", name, outputID, body, err)
+		}
+	}
+}
+
+func TestRedisPutError(t *testing.T) {
+	mr, r := newTestRedis(t, RedisOptions{})
+	ctx := context.Background()
+	if err := r.Put(ctx, actionIDOf("short"), actionIDOf("o"), 5, strings.NewReader("abc")); err == nil {
+		t.Errorf("Put of a short body succeeded")
+	}
+	mr.SetError("unavailable")
+	if err := r.Put(ctx, actionIDOf("a"), actionIDOf("o"), 3, strings.NewReader("abc")); err == nil {
+		t.Errorf("Put succeeded on a failing server")
+	}
+	if r.Count.PutErrors.Load() != 2 {
+		t.Errorf("PutErrors = %d, want 2", r.Count.PutErrors.Load())
+	}
+}
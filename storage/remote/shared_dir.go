@@ -0,0 +1,316 @@
+package remote
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/reillywatson/gocache/storage/count"
+)
+
+// staleLockAge is how old a lock file must be before it is considered left
+// behind by a crashed writer and broken.
+const staleLockAge = 10 * time.Minute
+
+// lockPollInterval is how often a put waiting for the lock of another host
+// checks whether it was released, and lockWaitTimeout how long it waits
+// before it gives up and skips the put.
+var (
+	lockPollInterval = 100 * time.Millisecond
+	lockWaitTimeout  = 5 * time.Second
+)
+
+// errOutputLocked is returned by putOutput when another host held the lock
+// of the output for longer than lockWaitTimeout.
+var errOutputLocked = errors.New("output locked by another host")
+
+// sharedDirEntry is the sidecar that SharedDir stores for an ActionID.
+type sharedDirEntry struct {
+	OutputID  string `json:"outputid"`
+	Size      int64  `json:"size"`
+	TimeNanos int64  `json:"time"`
+}
+
+var _ Storage = &SharedDir{}
+
+// SharedDir is a remote cache that is backed by a directory shared between
+// hosts, such as an NFS or SMB mount. Unlike local.Disk it does not assume it
+// owns the directory: outputs are content addressed and written with a
+// temporary file and a rename, and each action is a JSON sidecar that is
+// replaced atomically once its output is in place, so readers never see a
+// partial entry and concurrent writers of the same entry do not conflict.
+type SharedDir struct {
+	root       string
+	bucketPath string
+	verbose    bool
+	lockWaits  atomic.Int64
+	lockSkips  atomic.Int64
+	count.Count
+}
+
+// NewSharedDir creates a new SharedDir instance in the root directory.
+func NewSharedDir(root string, cacheKey string, verbose bool) *SharedDir {
+	bucketPath := filepath.FromSlash(BucketPath(cacheKey))
+
+	return &SharedDir{
+		root:       root,
+		bucketPath: bucketPath,
+		verbose:    verbose,
+	}
+}
+
+func (s *SharedDir) dir() string {
+	return filepath.Join(s.root, s.bucketPath)
+}
+
+// actionFile and outputFile shard the entries by the first byte of their ID,
+// the same way as local.Disk.
+func (s *SharedDir) actionFile(actionID string) string {
+	return filepath.Join(s.dir(), actionID[:2], "a-"+actionID)
+}
+
+func (s *SharedDir) outputFile(outputID string) string {
+	return filepath.Join(s.dir(), outputID[:2], "o-"+outputID)
+}
+
+func (s *SharedDir) Kind() string {
+	return "shared-dir"
+}
+
+func (s *SharedDir) Start(ctx context.Context) error {
+	if s.verbose {
+		log.Printf("[%s] start to %s", s.Kind(), s.dir())
+	}
+	if err := os.MkdirAll(s.dir(), 0755); err != nil {
+		return fmt.Errorf("[%s] failed to start %s: %w", s.Kind(), s.dir(), err)
+	}
+	return nil
+}
+
+func (s *SharedDir) Get(ctx context.Context, actionID string) (string, int64, time.Time, io.ReadCloser, error) {
+	s.Count.Gets.Add(1)
+	if !validID(actionID) {
+		s.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (invalid actionID)", s.Kind(), actionID)
+	}
+	actionFile := s.actionFile(actionID)
+	ej, err := os.ReadFile(actionFile)
+	if errors.Is(err, os.ErrNotExist) {
+		s.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		s.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", s.Kind(), actionFile, err)
+	}
+	var e sharedDirEntry
+	if err := json.Unmarshal(ej, &e); err != nil || !validID(e.OutputID) {
+		s.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (invalid entry)", s.Kind(), actionFile)
+	}
+
+	outputFile := s.outputFile(e.OutputID)
+	f, err := os.Open(outputFile)
+	if errors.Is(err, os.ErrNotExist) {
+		// Another host may have removed the output; treat it as a miss.
+		s.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	if err != nil {
+		s.Count.GetErrors.Add(1)
+		return "", 0, time.Time{}, nil, fmt.Errorf("[%s] get %s (%v)", s.Kind(), outputFile, err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != e.Size {
+		_ = f.Close()
+		s.Count.Misses.Add(1)
+		return "", 0, time.Time{}, nil, nil
+	}
+	return e.OutputID, e.Size, time.Unix(0, e.TimeNanos), f, nil
+}
+
+func (s *SharedDir) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	s.Count.Puts.Add(1)
+	if !validID(actionID) || !validID(outputID) {
+		s.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (invalid actionID or outputID %s)", s.Kind(), actionID, outputID)
+	}
+	err := s.putOutput(ctx, outputID, size, body)
+	if errors.Is(err, errOutputLocked) {
+		// The other host is probably still writing the output, and the
+		// action will be put again by the next build that misses it.
+		s.lockSkips.Add(1)
+		if s.verbose {
+			log.Printf("[%s] put skipped for %s (output %s locked by another host)", s.Kind(), actionID, outputID)
+		}
+		return nil
+	}
+	if err != nil {
+		s.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", s.Kind(), actionID, outputID, size, err)
+	}
+
+	ej, err := json.Marshal(sharedDirEntry{
+		OutputID:  outputID,
+		Size:      size,
+		TimeNanos: time.Now().UnixNano(),
+	})
+	if err != nil {
+		s.Count.PutErrors.Add(1)
+		return err
+	}
+	actionFile := s.actionFile(actionID)
+	if err := writeFileAtomic(actionFile, ej); err != nil {
+		s.Count.PutErrors.Add(1)
+		return fmt.Errorf("[%s] put failed for %s (outputID: %s, size: %d): %w", s.Kind(), actionFile, outputID, size, err)
+	}
+
+	if s.verbose {
+		log.Printf("[%s] put success for %s (outputID: %s, size: %d)", s.Kind(), actionFile, outputID, size)
+	}
+	return nil
+}
+
+// putOutput writes the output unless it is already present. The output is
+// locked while it is written so that hosts putting the same output do not
+// all copy it; if another host holds the lock, putOutput waits until it is
+// released, so that the sidecar is only written once the output is in place,
+// and then writes the output if the other host did not. It returns
+// errOutputLocked if the lock is still held after lockWaitTimeout.
+func (s *SharedDir) putOutput(ctx context.Context, outputID string, size int64, body io.Reader) error {
+	outputFile := s.outputFile(outputID)
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return err
+	}
+	waited := false
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		if fi, err := os.Stat(outputFile); err == nil && fi.Size() == size {
+			return nil
+		}
+		unlock, ok := lockFile(outputFile + ".lock")
+		if ok {
+			defer unlock()
+			break
+		}
+		if !waited {
+			waited = true
+			s.lockWaits.Add(1)
+			if s.verbose {
+				log.Printf("[%s] %s is being written by another host, waiting", s.Kind(), outputFile)
+			}
+		}
+		if time.Now().After(deadline) {
+			return errOutputLocked
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+	// The output may have been written between the check and the lock.
+	if fi, err := os.Stat(outputFile); err == nil && fi.Size() == size {
+		return nil
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(outputFile), filepath.Base(outputFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tf.Close()
+		_ = os.Remove(tf.Name())
+	}()
+	wrote, err := io.Copy(tf, body)
+	if err != nil {
+		return err
+	}
+	if wrote != size {
+		return fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), outputFile)
+}
+
+// lockFile takes the lock at path by creating it exclusively, which is atomic
+// on NFS and SMB mounts. A lock older than staleLockAge is broken. It reports
+// false without blocking if the lock is held.
+func lockFile(path string) (unlock func(), ok bool) {
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, true
+		}
+		if !errors.Is(err, os.ErrExist) {
+			// Write without the lock rather than fail if locking is not supported.
+			return func() {}, true
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			// The lock was released in the meantime.
+			continue
+		}
+		if time.Since(fi.ModTime()) < staleLockAge {
+			return nil, false
+		}
+		_ = os.Remove(path)
+	}
+	return nil, false
+}
+
+// writeFileAtomic replaces the file at path with data.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tf.Close()
+		_ = os.Remove(tf.Name())
+	}()
+	if _, err := tf.Write(data); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), path)
+}
+
+// validID reports whether id is a hex ID that is safe to use in a path.
+func validID(id string) bool {
+	if len(id) < 2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (s *SharedDir) Close() error {
+	return nil
+}
+
+func (s *SharedDir) Summary() string {
+	summary := s.Count.Summary(s.Kind())
+	if waits := s.lockWaits.Load(); waits > 0 {
+		summary += fmt.Sprintf("\n[%s] %d puts waited for another host to write the output", s.Kind(), waits)
+	}
+	if skips := s.lockSkips.Load(); skips > 0 {
+		summary += fmt.Sprintf("\n[%s] %d puts skipped as another host held the output lock", s.Kind(), skips)
+	}
+	return summary
+}
@@ -0,0 +1,186 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSharedDir(t *testing.T) *SharedDir {
+	t.Helper()
+	s := NewSharedDir(t.TempDir(), "v1", false)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	old := lockPollInterval
+	lockPollInterval = time.Millisecond
+	t.Cleanup(func() { lockPollInterval = old })
+	return s
+}
+
+func sharedDirGet(t *testing.T, s *SharedDir, actionID string) (string, []byte) {
+	t.Helper()
+	outputID, _, _, body, err := s.Get(context.Background(), actionID)
+	if err != nil || body == nil {
+		t.Fatalf("Get = %v, %v; want a hit", body, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outputID, data
+}
+
+func TestSharedDirPutGet(t *testing.T) {
+	s := newTestSharedDir(t)
+	ctx := context.Background()
+	data := []byte("hello, world")
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	if err := s.Put(ctx, actionIDOf("a"), outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if gotOutputID, got := sharedDirGet(t, s, actionIDOf("a")); gotOutputID != outputID || !bytes.Equal(got, data) {
+		t.Errorf("Get = %s, %q; want %s, %q", gotOutputID, got, outputID, data)
+	}
+	if _, _, _, body, err := s.Get(ctx, actionIDOf("missing")); err != nil || body != nil {
+		t.Errorf("Get = %v, %v; want a miss", body, err)
+	}
+}
+
+// A put of an output locked by another host waits for it, and writes the
+// action once the output is in place.
+func TestSharedDirPutLockedOutput(t *testing.T) {
+	for _, otherWrites := range []bool{true, false} {
+		s := newTestSharedDir(t)
+		data := []byte("hello, world")
+		sum := sha256.Sum256(data)
+		outputID := hex.EncodeToString(sum[:])
+		outputFile := s.outputFile(outputID)
+		if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(outputFile+".lock", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Put(context.Background(), actionIDOf("a"), outputID, int64(len(data)), bytes.NewReader(data))
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("Put returned while the output was locked: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if _, err := os.Stat(s.actionFile(actionIDOf("a"))); err == nil {
+			t.Fatalf("action written before its output")
+		}
+
+		// The other host writes the output, or gives up, and releases the lock.
+		if otherWrites {
+			if err := os.WriteFile(outputFile, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Remove(outputFile + ".lock"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if gotOutputID, got := sharedDirGet(t, s, actionIDOf("a")); gotOutputID != outputID || !bytes.Equal(got, data) {
+			t.Errorf("otherWrites=%v: Get = %s, %q; want %s, %q", otherWrites, gotOutputID, got, outputID, data)
+		}
+		if s.lockWaits.Load() != 1 {
+			t.Errorf("otherWrites=%v: lockWaits = %d, want 1", otherWrites, s.lockWaits.Load())
+		}
+	}
+}
+
+func TestSharedDirPutLockedCanceled(t *testing.T) {
+	s := newTestSharedDir(t)
+	outputID := actionIDOf("o")
+	outputFile := s.outputFile(outputID)
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outputFile+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Put(ctx, actionIDOf("a"), outputID, 1, bytes.NewReader([]byte("x"))); err == nil {
+		t.Errorf("Put succeeded while the output was locked")
+	}
+	if _, err := os.Stat(s.actionFile(actionIDOf("a"))); err == nil {
+		t.Errorf("action written without its output")
+	}
+}
+
+// A put gives up on an output that another host keeps locked, rather than
+// hold up the build until the lock goes stale.
+func TestSharedDirPutLockedTimeout(t *testing.T) {
+	s := newTestSharedDir(t)
+	old := lockWaitTimeout
+	lockWaitTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { lockWaitTimeout = old })
+	outputID := actionIDOf("o")
+	outputFile := s.outputFile(outputID)
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outputFile+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(context.Background(), actionIDOf("a"), outputID, 1, bytes.NewReader([]byte("x"))); err != nil {
+		t.Errorf("Put = %v, want the put skipped", err)
+	}
+	if _, err := os.Stat(s.actionFile(actionIDOf("a"))); err == nil {
+		t.Errorf("action written without its output")
+	}
+	if s.lockSkips.Load() != 1 || s.Count.PutErrors.Load() != 0 {
+		t.Errorf("lockSkips = %d, PutErrors = %d; want 1, 0", s.lockSkips.Load(), s.Count.PutErrors.Load())
+	}
+}
+
+func TestSharedDirStorage(t *testing.T) {
+	testStorage(t, newTestSharedDir(t))
+}
+
+// A corrupt sidecar is an error, an output that does not match it a miss.
+func TestSharedDirCorruptEntry(t *testing.T) {
+	s := newTestSharedDir(t)
+	ctx := context.Background()
+	data := []byte("hello, world")
+	sum := sha256.Sum256(data)
+	outputID := hex.EncodeToString(sum[:])
+	for _, name := range []string{"truncated", "corrupt"} {
+		if err := s.Put(ctx, actionIDOf(name), outputID, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := os.WriteFile(s.actionFile(actionIDOf("corrupt")), []byte(`{"outputid":"../x"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.outputFile(outputID), data[:4], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, body, err := s.Get(ctx, actionIDOf("truncated")); err != nil || body != nil {
+		t.Errorf("Get of a truncated output = %v, %v; want a miss", body, err)
+	}
+	if _, _, _, body, err := s.Get(ctx, actionIDOf("corrupt")); err == nil || body != nil {
+		t.Errorf("Get of a corrupt sidecar = %v, %v; want an error", body, err)
+	}
+	if _, _, _, _, err := s.Get(ctx, "../x"); err == nil {
+		t.Errorf("Get of an invalid action ID succeeded")
+	}
+}
@@ -3,17 +3,49 @@ package remote
 import (
 	"context"
 	"io"
+	"os"
+	"path"
+	"runtime"
+	"time"
 )
 
 const (
 	outputIDMetadataKey = "outputid"
 )
 
+// BucketPath is the path under which the objects of cacheKey are stored for
+// the target platform and Go version, as objects are not shared between them.
+// GOARCH, GOOS and GOVERSION are read from the environment that the go command
+// passes to GOCACHEPROG, falling back to those of this binary.
+func BucketPath(cacheKey string) string {
+	goarch := os.Getenv("GOARCH")
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	goos := os.Getenv("GOOS")
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	goVersion := os.Getenv("GOVERSION")
+	if goVersion == "" {
+		goVersion = runtime.Version()
+	}
+	return path.Join("cache", cacheKey, goarch, goos, goVersion)
+}
+
 type Storage interface {
 	Kind() string
 	Start(ctx context.Context) error
-	Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error)
+	Get(ctx context.Context, actionID string) (outputID string, size int64, putTime time.Time, output io.ReadCloser, err error)
 	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error)
 	Close() error
 	Summary() string
 }
+
+// PutSkipper is implemented by the remote storages that can look up an object
+// without downloading it, to avoid uploading the objects they already have.
+type PutSkipper interface {
+	// SkipPut reports whether outputID is already stored for actionID with
+	// the given size, in which case the put is counted as skipped.
+	SkipPut(ctx context.Context, actionID, outputID string, size int64) (bool, error)
+}
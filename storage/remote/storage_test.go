@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testStorage checks the behavior that every remote storage shares: unknown
+// actions are misses, objects of any size read back unchanged, a put
+// replaces the output of an action, and a PutSkipper only skips the output
+// it stores. s must be started, and should be empty.
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	start := time.Now()
+
+	outputID, _, _, body, err := s.Get(ctx, actionIDOf("missing"))
+	if err != nil || outputID != "" || body != nil {
+		t.Errorf("Get of a missing action = %q, %v, %v; want a miss", outputID, body, err)
+	}
+
+	for _, size := range []int{0, 1, 100, 64 << 10} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		putGet(t, s, actionIDOf(fmt.Sprintf("size %d", size)), data)
+	}
+
+	actionID := actionIDOf("replaced")
+	putGet(t, s, actionID, []byte("first"))
+	putGet(t, s, actionID, []byte("second output"))
+
+	_, _, putTime, body, err := s.Get(ctx, actionID)
+	if err != nil || body == nil {
+		t.Fatalf("Get = %v, %v; want a hit", body, err)
+	}
+	_ = body.Close()
+	// Some services only record the put time to the second.
+	if !putTime.IsZero() && (putTime.Before(start.Add(-time.Minute)) || putTime.After(time.Now().Add(time.Minute))) {
+		t.Errorf("put time = %v, want the time of the put", putTime)
+	}
+
+	if skipper, ok := s.(PutSkipper); ok {
+		data := []byte("second output")
+		if skip, err := skipper.SkipPut(ctx, actionID, actionIDOf(string(data)), int64(len(data))); err != nil || !skip {
+			t.Errorf("SkipPut of the stored output = %v, %v; want true", skip, err)
+		}
+		if skip, err := skipper.SkipPut(ctx, actionID, actionIDOf("first"), 5); err != nil || skip {
+			t.Errorf("SkipPut of a replaced output = %v, %v; want false", skip, err)
+		}
+		if skip, err := skipper.SkipPut(ctx, actionIDOf("missing"), actionIDOf("first"), 5); err != nil || skip {
+			t.Errorf("SkipPut of a missing action = %v, %v; want false", skip, err)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(1<<20, false)
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, m)
+}
@@ -1,43 +1,112 @@
 package storage
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/reillywatson/gocache/storage/local"
 	"github.com/reillywatson/gocache/storage/remote"
 )
 
-// New creates a new cache instance.
-//
-// Cache storage option:
-// 1. only local disk
-// 2. Amazon S3 and local disk
-// 3. Google Cloud Storage and local disk
-func New(ctx context.Context, cacheDir, s3Bucket, gcsBucket, cacheKey string, verbose bool) local.Storage {
-	disk := local.NewDisk(verbose, cacheDir)
+// Options configures the cache built by New.
+type Options struct {
+	CacheDir       string
+	RemoteURL      string
+	Tiers          []string
+	S3Bucket       string
+	GCSBucket      string
+	HTTPURL        string
+	REAPITarget    string
+	RedisURL       string
+	AzureContainer string
+	SharedDir      string
+	OCIRepository  string
+	GitHubActions  bool
+	CacheKey       string
+	Verbose        bool
+	Disk           local.DiskOptions
+	Remote         local.MergeRemoteOptions
+	Breaker        remote.BreakerOptions
+	S3             remote.AmazonS3Options
+	HTTP           remote.HTTPOptions
+	REAPI          remote.REAPIOptions
+	Redis          remote.RedisOptions
+	GCS            remote.GoogleCloudStorageOptions
+	Azure          remote.AzureBlobOptions
+	OCI            remote.OCIOptions
+	Actions        remote.GitHubActionsOptions
+}
 
-	switch {
-	case s3Bucket != "":
-		s3Client, err := remote.NewAmazonS3Client(ctx)
-		if err != nil {
-			log.Printf("Warning: Amazon S3 configuration failed: %v", err)
-			return disk
-		}
+// New creates a new cache instance: the local disk, merged with the remote
+// cache if one is configured.
+//
+// The remote cache is configured by RemoteURL, whose scheme selects one of
+// the constructors registered with RegisterRemote:
+//  1. s3://<bucket>/<prefix>: Amazon S3 or an S3-compatible service
+//  2. gs://<bucket>/<prefix>: Google Cloud Storage
+//  3. azblob://<container>/<prefix>: Azure Blob Storage
+//  4. http:// and https://: HTTP cache server
+//  5. grpc://<host:port>/<instance> and grpcs://: Remote Execution API cache
+//  6. redis:// and rediss://: Redis or Valkey
+//  7. file:///<dir>: shared directory
+//  8. oci://<registry>/<repository>: OCI registry
+//  9. gha://: GitHub Actions cache
+//
+// The provider options such as S3Bucket are shorthands for these URLs. It is
+// an error to configure more than one remote cache, or to use an unknown
+// scheme. If the remote cache cannot be created, for example because of
+// missing credentials, only the local disk is used.
+//
+// Tiers instead configures a chain of remote caches, from the fastest to the
+// slowest, such as mem:// then an HTTP peer then S3. The read and write
+// options of a tier URL set its policies, e.g. https://peer/?write=back. The
+// leading mem:// tiers are looked up before the local disk, the others after.
+//
+// With a remote cache or tiers, concurrent gets and puts for the same action
+// are coalesced. The local disk alone is fast enough not to need it.
+func New(ctx context.Context, opts Options) (local.Storage, error) {
+	disk := local.NewDisk(opts.Verbose, opts.CacheDir, opts.Disk)
+	if len(opts.Tiers) > 0 {
+		return newChain(ctx, disk, opts)
+	}
 
-		amazonS3 := remote.NewAmazonS3(s3Client, s3Bucket, cacheKey, verbose)
-		return local.NewMergeRemote(disk, amazonS3, verbose)
+	remoteStorage, err := newRemote(ctx, opts)
+	if errors.Is(err, errInvalidRemote) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return disk, nil
+	}
+	if remoteStorage == nil {
+		return disk, nil
+	}
+	return local.NewCoalesce(local.NewMergeRemote(disk, remoteStorage, opts.Remote, opts.Verbose), opts.Verbose), nil
+}
 
-	case gcsBucket != "":
-		cloudStorageClient, err := remote.NewGoogleCloudStorageClient(ctx)
+// newChain creates a chain of the local disk and the tiers. Tiers that cannot
+// be created are left out.
+func newChain(ctx context.Context, disk local.Storage, opts Options) (local.Storage, error) {
+	if u, err := remoteURL(opts); err != nil || u != nil {
+		return nil, cmp.Or(err, fmt.Errorf("%w: --tier cannot be combined with another remote cache option", errInvalidRemote))
+	}
+	var tiers []local.Tier
+	for _, rawURL := range opts.Tiers {
+		tier, err := newTier(ctx, rawURL, opts)
+		if errors.Is(err, errInvalidRemote) {
+			return nil, err
+		}
 		if err != nil {
-			log.Printf("Warning: Google Cloud Storage configuration failed: %v", err)
-			return disk
+			log.Printf("Warning: %v", err)
+			continue
 		}
-
-		googleCloudStorage := remote.NewGoogleCloudStorage(cloudStorageClient, gcsBucket, cacheKey, verbose)
-		return local.NewMergeRemote(disk, googleCloudStorage, verbose)
-	default:
-		return disk
+		tiers = append(tiers, tier)
+	}
+	if len(tiers) == 0 {
+		return disk, nil
 	}
+	return local.NewCoalesce(local.NewChain(disk, tiers, opts.Remote, opts.Verbose), opts.Verbose), nil
 }
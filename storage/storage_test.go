@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/reillywatson/gocache/storage/local"
+)
+
+// Only the storages with a remote cache coalesce the concurrent calls.
+func TestNewCoalesce(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		opts Options
+		want bool
+	}{
+		{Options{}, false},
+		{Options{RemoteURL: "mem://"}, true},
+		{Options{Tiers: []string{"mem://"}}, true},
+	} {
+		tt.opts.CacheDir = t.TempDir()
+		s, err := New(ctx, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.(*local.Coalesce); ok != tt.want {
+			t.Errorf("New(%+v) = %T, want coalesced: %v", tt.opts, s, tt.want)
+		}
+	}
+}